@@ -24,8 +24,15 @@ func main() {
 		return
 	}
 
-	smartcrop := resizer.NewSmartcrop(*haarcascade, paint.CropResizer{})
+	smartcrop, err := resizer.NewSmartcrop(*haarcascade, paint.CropResizer{})
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+
 	paint.AddResizer(resizer.TypeSmartcrop, smartcrop)
+	paint.SetFaceDetector(smartcrop)
 
-	run(*host, *configurationFilepath, *newrelicKey, *serverPort)
+	// the haarcascade is released on shutdown, once all requests in flight have been answered
+	run(*host, *configurationFilepath, *newrelicKey, *serverPort, smartcrop)
 }
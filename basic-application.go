@@ -3,8 +3,15 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/VoycerAG/gridfs-image-server/server"
 	"gopkg.in/mgo.v2"
@@ -15,45 +22,172 @@ var (
 	serverPort            *int
 	host                  *string
 	newrelicKey           *string
+	filesystemRoot        *string
+	filesystemCache       *string
+	objectEndpoint        *string
+	objectRegion          *string
+	gridfsPrefix          *string
+	gridfsChildPrefix     *string
+	dedupNamespace        *string
 )
 
+// shutdownTimeout is the maximum time requests in flight may take after a shutdown signal
+const shutdownTimeout = 30 * time.Second
+
 func init() {
 	configurationFilepath = flag.String("config", "configuration.json", "path to the configuration file")
 	serverPort = flag.Int("port", 8000, "the server port where we will serve images")
 	host = flag.String("host", "localhost:27017", "the database host with an optional port, localhost would suffice")
 	newrelicKey = flag.String("license", "", "your newrelic license key in order to enable monitoring")
+	filesystemRoot = flag.String("filesystem", "", "serve images from this directory instead of gridfs, every subdirectory is a database")
+	filesystemCache = flag.String("cache", "", "directory for resized images when serving from the filesystem (default filesystem directory with suffix -cache)")
+	objectEndpoint = flag.String("s3", "", "serve images from this s3 compatible endpoint instead of gridfs, every bucket is a database. Credentials are read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	objectRegion = flag.String("s3region", "us-east-1", "the region of the s3 endpoint")
+	gridfsPrefix = flag.String("prefix", server.DefaultPrefix, "the gridfs prefix of originals, if no bucket is given in the request")
+	gridfsChildPrefix = flag.String("childprefix", "", "the gridfs prefix where resized images will be stored (default prefix of the original)")
+	dedupNamespace = flag.String("dedup", "", "remove duplicate resized images of this database (or database/bucket) and exit")
 }
 
-func run(mongoHost, configFile, newrelicToken string, port int) {
-	session, err := mgo.Dial(*host)
+// run serves images until the process receives SIGINT or SIGTERM. Requests in flight
+// are answered before the closers are closed and the process exits
+func run(mongoHost, configFile, newrelicToken string, port int, closers ...io.Closer) {
+	config, err := server.NewConfigFromFile(configFile)
 	if err != nil {
 		log.Fatal(err)
 		return
 	}
 
-	config, err := server.NewConfigFromFile(configFile)
+	storage, err := newStorage(mongoHost)
 	if err != nil {
 		log.Fatal(err)
 		return
 	}
 
-	session.SetSyncTimeout(0)
-	session.SetMode(mgo.Eventual, true)
+	if *dedupNamespace != "" {
+		deduplicator, ok := storage.(server.Deduplicator)
+		if !ok {
+			log.Fatal("the storage does not support removing duplicates")
+			return
+		}
 
-	storage, err := server.NewGridfsStorage(session)
-	if err != nil {
-		log.Fatal(err)
+		removed, err := deduplicator.RemoveDuplicates(*dedupNamespace)
+		if err != nil {
+			log.Fatal(err)
+			return
+		}
+
+		log.Printf("Removed %d duplicate resized images from %s\n", removed, *dedupNamespace)
 		return
 	}
 
 	imageServer := server.NewImageServerWithNewRelic(config, storage, newrelicToken)
 
-	handler := imageServer.Handler()
+	handler := &drainingHandler{handler: imageServer.Handler()}
 
-	log.Printf("Server started. Listening on %d database host is %s\n", port, mongoHost)
+	if *filesystemRoot != "" {
+		log.Printf("Server started. Listening on %d serving files from %s\n", port, *filesystemRoot)
+	} else if *objectEndpoint != "" {
+		log.Printf("Server started. Listening on %d object storage is %s\n", port, *objectEndpoint)
+	} else {
+		log.Printf("Server started. Listening on %d database host is %s\n", port, mongoHost)
+	}
 
-	err = http.ListenAndServe(fmt.Sprintf(":%d", port), handler)
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
 		log.Fatal(err)
+		return
+	}
+
+	stopping := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		close(stopping)
+		// no new connections will be accepted, so serving returns
+		listener.Close()
+	}()
+
+	err = http.Serve(listener, handler)
+	select {
+	case <-stopping:
+	default:
+		log.Fatal(err)
 	}
+
+	log.Println("Shutting down, waiting for requests in flight")
+	if !handler.drain(shutdownTimeout) {
+		log.Printf("Requests were still in flight after %s\n", shutdownTimeout)
+	}
+
+	for _, closer := range closers {
+		closer.Close()
+	}
+}
+
+// drainingHandler keeps track of the requests in flight, so they can be answered before shutting down
+type drainingHandler struct {
+	handler  http.Handler
+	lock     sync.Mutex
+	inFlight sync.WaitGroup
+	draining bool
+}
+
+func (d *drainingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.lock.Lock()
+	if d.draining {
+		d.lock.Unlock()
+		// requests of kept alive connections might still arrive
+		w.Header().Set("Connection", "close")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	d.inFlight.Add(1)
+	d.lock.Unlock()
+	defer d.inFlight.Done()
+
+	d.handler.ServeHTTP(w, r)
+}
+
+// drain rejects all further requests and waits until the requests in flight have been answered.
+// It returns false if they took longer than timeout
+func (d *drainingHandler) drain(timeout time.Duration) bool {
+	d.lock.Lock()
+	d.draining = true
+	d.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.inFlight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// newStorage returns a filesystem or object storage if configured, gridfs otherwise
+func newStorage(mongoHost string) (server.Storage, error) {
+	if *filesystemRoot != "" {
+		return server.NewFilesystemStorage(*filesystemRoot, *filesystemCache)
+	}
+
+	if *objectEndpoint != "" {
+		return server.NewObjectStorage(*objectEndpoint, *objectRegion, os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"))
+	}
+
+	session, err := mgo.Dial(mongoHost)
+	if err != nil {
+		return nil, err
+	}
+
+	session.SetSyncTimeout(0)
+	session.SetMode(mgo.Eventual, true)
+
+	return server.NewGridfsStorageWithPrefix(session, *gridfsPrefix, *gridfsChildPrefix)
 }
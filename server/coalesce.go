@@ -0,0 +1,68 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+//resizeResult is the outcome of a resize that can be shared between requests
+type resizeResult struct {
+	image  Cacheable
+	data   []byte
+	status int
+	err    error
+}
+
+//resizeCall is a resize that is currently running
+type resizeCall struct {
+	done   sync.WaitGroup
+	result resizeResult
+}
+
+//resizeGroup coalesces concurrent resizes of the same image.
+//Only the first request for a key will resize, all others will wait for and share its result
+type resizeGroup struct {
+	lock  sync.Mutex
+	calls map[string]*resizeCall
+}
+
+func newResizeGroup() *resizeGroup {
+	return &resizeGroup{calls: map[string]*resizeCall{}}
+}
+
+//do runs resize, unless a resize for key is already running.
+//shared is true if the result of another request has been returned.
+//If resize panics, the waiting requests will get an internal server error and the panic is passed on
+func (g *resizeGroup) do(key string, resize func() resizeResult) (result resizeResult, shared bool) {
+	g.lock.Lock()
+	if call, running := g.calls[key]; running {
+		g.lock.Unlock()
+		call.done.Wait()
+		return call.result, true
+	}
+
+	call := &resizeCall{}
+	call.done.Add(1)
+	g.calls[key] = call
+	g.lock.Unlock()
+
+	defer func() {
+		recovered := recover()
+		if recovered != nil {
+			call.result = resizeResult{status: http.StatusInternalServerError, err: fmt.Errorf("resize panicked: %v", recovered)}
+		}
+
+		g.lock.Lock()
+		delete(g.calls, key)
+		g.lock.Unlock()
+		call.done.Done()
+
+		if recovered != nil {
+			panic(recovered)
+		}
+	}()
+
+	call.result = resize()
+	return call.result, false
+}
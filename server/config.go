@@ -4,22 +4,104 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"log"
+	"runtime"
+	"strings"
 
 	"github.com/VoycerAG/gridfs-image-server/server/paint"
 )
 
+const (
+	// DefaultUploadMaxBytes is the maximum size of uploaded files if not configured
+	DefaultUploadMaxBytes = 20 << 20
+	// DefaultUploadMaxPixels is the maximum number of pixels of uploaded images if not configured
+	DefaultUploadMaxPixels = 50000000
+	// DefaultQueueDepth is the number of requests that may wait for image processing if not configured
+	DefaultQueueDepth = 100
+	// DefaultQueueTimeout is the time in milliseconds a request may wait for image processing if not configured
+	DefaultQueueTimeout = 5000
+	// DefaultMaxPixels is the maximum number of pixels of images that will be decoded if not configured
+	DefaultMaxPixels = 100000000
+)
+
 // Config contains entries for
 // possible image configurations
+// AuthToken must be sent as bearer token in order to modify images,
+// if it is empty, images can not be modified via http.
+// Images exceeding the Limits will not be decoded.
+// With AcceptNegotiation, resized images are served as webp to clients that accept it.
 type Config struct {
-	AllowedEntries []Entry `json:allowedEntries`
+	AllowedEntries    []Entry          `json:allowedEntries`
+	AuthToken         string           `json:"authToken"`
+	Upload            UploadConfig     `json:"upload"`
+	Processing        ProcessingConfig `json:"processing"`
+	Limits            paint.Limits     `json:"limits"`
+	AcceptNegotiation bool             `json:"acceptNegotiation"`
+}
+
+// UploadConfig restricts uploaded images
+type UploadConfig struct {
+	MaxBytes  int64 `json:"maxBytes"`
+	MaxPixels int64 `json:"maxPixels"`
+}
+
+// ProcessingConfig limits the number of images that are decoded and resized at the same time.
+// MaxConcurrent defaults to the number of cpus, QueueTimeout is given in milliseconds.
+type ProcessingConfig struct {
+	MaxConcurrent int   `json:"maxConcurrent"`
+	QueueDepth    int   `json:"queueDepth"`
+	QueueTimeout  int64 `json:"queueTimeout"`
+}
+
+// withDefaults returns the config with defaults for all limits that are not set
+func (p ProcessingConfig) withDefaults() ProcessingConfig {
+	if p.MaxConcurrent <= 0 {
+		p.MaxConcurrent = runtime.NumCPU()
+	}
+
+	if p.QueueDepth <= 0 {
+		p.QueueDepth = DefaultQueueDepth
+	}
+
+	if p.QueueTimeout <= 0 {
+		p.QueueTimeout = DefaultQueueTimeout
+	}
+
+	return p
 }
 
 // Entry is one allowed image configuration
+// Format is the optional output format of resized images, see paint.OutputFormat
+// Quality, Lossless, PNGCompression and Metadata control the encoding, see paint.EncodeOptions
+// Progressive is ignored with a warning, because none of the encoders can write progressive images yet
+// Flatten keeps only the first frame of animated gifs
+// AutoOrient rotates and flips jpeg images according to their exif orientation before resizing
+// Background and Alignment are used by the pad type, the background defaults to white for jpeg and transparent otherwise
+// and must be opaque if the resized image might be a jpeg
+// MinFaceArea, DetectionSize, FacePadding and Fallback configure the face detection, see paint.FaceOptions
 type Entry struct {
 	Name   string           `json:name`
 	Width  int64            `json:width`
 	Height int64            `json:height`
 	Type   paint.ResizeType `json:type`
+	Format string           `json:"format"`
+
+	Quality        int                  `json:"quality"`
+	Lossless       bool                 `json:"lossless"`
+	Progressive    bool                 `json:"progressive"`
+	PNGCompression paint.PNGCompression `json:"pngCompression"`
+	Metadata       paint.MetadataPolicy `json:"metadata"`
+	Flatten        bool                 `json:"flatten"`
+	AutoOrient     bool                 `json:"autoOrient"`
+	Background     string               `json:"background"`
+	Alignment      paint.Alignment      `json:"alignment"`
+	MinFaceArea    float64              `json:"minFaceArea"`
+	DetectionSize  int                  `json:"detectionSize"`
+	FacePadding    *float64             `json:"facePadding"`
+	Fallback       paint.ResizeType     `json:"fallback"`
+
+	// negotiated is set if the format has been negotiated with the client
+	negotiated bool
 }
 
 //NewConfigFromBytes generates a new config object by a byte stream
@@ -48,6 +130,32 @@ func NewConfigFromFile(file string) (*Config, error) {
 
 // validateConfig validates the configuration and fills elements with default types.
 func (config *Config) validateConfig() error {
+	if config.Upload.MaxBytes < 0 || config.Upload.MaxPixels < 0 {
+		return fmt.Errorf("Upload limits must not be negative")
+	}
+
+	if config.Upload.MaxBytes == 0 {
+		config.Upload.MaxBytes = DefaultUploadMaxBytes
+	}
+
+	if config.Upload.MaxPixels == 0 {
+		config.Upload.MaxPixels = DefaultUploadMaxPixels
+	}
+
+	if config.Processing.MaxConcurrent < 0 || config.Processing.QueueDepth < 0 || config.Processing.QueueTimeout < 0 {
+		return fmt.Errorf("Processing limits must not be negative")
+	}
+
+	config.Processing = config.Processing.withDefaults()
+
+	if config.Limits.MaxPixels < 0 || config.Limits.MaxWidth < 0 || config.Limits.MaxHeight < 0 {
+		return fmt.Errorf("Image limits must not be negative")
+	}
+
+	if config.Limits.MaxPixels == 0 {
+		config.Limits.MaxPixels = DefaultMaxPixels
+	}
+
 	for _, element := range config.AllowedEntries {
 		if element.Width <= 0 && element.Height <= 0 {
 			return fmt.Errorf("The width and height of the configuration element with name \"%s\" are invalid.", element.Name)
@@ -63,13 +171,169 @@ func (config *Config) validateConfig() error {
 
 		types := paint.GetAvailableTypes()
 		if _, found := types[element.Type]; !found {
-			return fmt.Errorf("Type must be either %s, %s or %s at element \"%s\"", paint.TypeCrop, paint.TypeResize, paint.TypeFit, element.Name)
+			return fmt.Errorf("Type must be either %s, %s, %s, %s, %s or %s at element \"%s\"",
+				paint.TypeCrop, paint.TypeResize, paint.TypeFit, paint.TypePad, paint.TypeFocus, paint.TypeSaliency, element.Name)
+		}
+
+		if element.Type == paint.TypePad && (element.Width <= 0 || element.Height <= 0) {
+			return fmt.Errorf("Width and height must be set for type %s at element \"%s\"", paint.TypePad, element.Name)
+		}
+
+		background, err := paint.ParseColor(element.Background)
+		if err != nil {
+			return fmt.Errorf("Background must be a color like #ffffff or transparent at element \"%s\"", element.Name)
+		}
+
+		// jpeg can not store transparency, without a format the original might be a jpeg as well
+		if _, _, _, alpha := background.RGBA(); element.Background != "" && alpha < 0xffff && (element.Format == "" || element.Format == "jpeg") {
+			return fmt.Errorf("Background must be opaque unless the format is png, gif, webp or auto at element \"%s\"", element.Name)
+		}
+
+		if !paint.IsValidAlignment(element.Alignment) {
+			return fmt.Errorf("Alignment %s is invalid at element \"%s\"", element.Alignment, element.Name)
+		}
+
+		if element.MinFaceArea < 0 || element.MinFaceArea > 1 || element.DetectionSize < 0 || (element.FacePadding != nil && *element.FacePadding < 0) {
+			return fmt.Errorf("Face detection options must not be negative and minFaceArea must not exceed 1 at element \"%s\"", element.Name)
+		}
+
+		if _, found := types[element.Fallback]; element.Fallback != "" && (!found || element.Fallback == element.Type) {
+			return fmt.Errorf("Fallback %s is invalid at element \"%s\"", element.Fallback, element.Name)
+		}
+
+		if element.Progressive {
+			log.Printf("Progressive encoding is not supported by any format yet and will be ignored at element \"%s\"\n", element.Name)
+		}
+
+		if element.Quality < 0 || element.Quality > 100 {
+			return fmt.Errorf("Quality must be between 1 and 100 at element \"%s\"", element.Name)
+		}
+
+		if !paint.IsValidPNGCompression(element.PNGCompression) {
+			return fmt.Errorf("PNG compression must be either %s, %s, %s or %s at element \"%s\"",
+				paint.PNGCompressionDefault, paint.PNGCompressionNone, paint.PNGCompressionFast, paint.PNGCompressionBest, element.Name)
+		}
+
+		if !paint.IsValidMetadataPolicy(element.Metadata) {
+			return fmt.Errorf("Metadata must be either %s, %s or %s at element \"%s\"",
+				paint.MetadataStrip, paint.MetadataICC, paint.MetadataCopyright, element.Name)
+		}
+
+		if element.Format == "webp" && !paint.CanEncode(element.Format) {
+			return fmt.Errorf("Format webp requires a server built with cgo and the build tag webp at element \"%s\"", element.Name)
+		}
+
+		if element.Format != "" && element.Format != paint.FormatAuto && !paint.CanEncode(element.Format) {
+			return fmt.Errorf("Format must be either jpeg, png, gif, webp or %s at element \"%s\"", paint.FormatAuto, element.Name)
 		}
 	}
 
 	return nil
 }
 
+// childKey returns a unique key for images resized by this entry.
+// The format and the options are only part of the key if they are set, so existing resized images remain valid.
+func (e Entry) childKey() string {
+	key := fmt.Sprintf("%dx%d_%s", e.Width, e.Height, e.Type)
+	if e.Format != "" {
+		key += "_" + e.Format
+	}
+
+	if options := e.optionsKey(); options != "" {
+		key += "_" + options
+	}
+
+	return key
+}
+
+// optionsKey returns a key for all options that are set, e.g. "q60-lossless".
+// Entries that only differ in their options must not share resized images,
+// options that are set to their default are left out, because they produce the same images.
+func (e Entry) optionsKey() string {
+	options := []string{}
+	if e.Quality != 0 {
+		options = append(options, fmt.Sprintf("q%d", e.Quality))
+	}
+
+	if e.Lossless {
+		options = append(options, "lossless")
+	}
+
+	if e.PNGCompression != "" && e.PNGCompression != paint.PNGCompressionDefault {
+		options = append(options, "png"+string(e.PNGCompression))
+	}
+
+	if e.Metadata != "" && e.Metadata != paint.MetadataStrip {
+		options = append(options, "meta"+string(e.Metadata))
+	}
+
+	if e.Flatten {
+		options = append(options, "flatten")
+	}
+
+	if e.AutoOrient {
+		options = append(options, "oriented")
+	}
+
+	if e.Background != "" {
+		options = append(options, "bg"+strings.TrimPrefix(e.Background, "#"))
+	}
+
+	if e.Alignment != "" {
+		options = append(options, "align"+string(e.Alignment))
+	}
+
+	if e.MinFaceArea != 0 {
+		options = append(options, fmt.Sprintf("faces%g", e.MinFaceArea))
+	}
+
+	if e.DetectionSize != 0 {
+		options = append(options, fmt.Sprintf("detect%d", e.DetectionSize))
+	}
+
+	if e.FacePadding != nil {
+		options = append(options, fmt.Sprintf("padding%g", *e.FacePadding))
+	}
+
+	if e.Fallback != "" {
+		options = append(options, "fallback"+string(e.Fallback))
+	}
+
+	return strings.Join(options, "-")
+}
+
+// resizeOptions returns the options to resize images by this entry, that will be encoded into format.
+func (e Entry) resizeOptions(format string) paint.ResizeOptions {
+	background := paint.DefaultBackground(format)
+	if e.Background != "" {
+		// the background has already been validated
+		background, _ = paint.ParseColor(e.Background)
+	}
+
+	return paint.ResizeOptions{
+		Background: background,
+		Alignment:  e.Alignment,
+		Faces: paint.FaceOptions{
+			MinArea:       e.MinFaceArea,
+			DetectionSize: e.DetectionSize,
+			Padding:       e.FacePadding,
+			Fallback:      e.Fallback,
+		},
+	}
+}
+
+// encodeOptions returns the options to encode images resized by this entry into format.
+func (e Entry) encodeOptions(format string) paint.EncodeOptions {
+	return paint.EncodeOptions{
+		Format:         format,
+		Quality:        e.Quality,
+		Lossless:       e.Lossless,
+		Progressive:    e.Progressive,
+		PNGCompression: e.PNGCompression,
+		Metadata:       e.Metadata,
+	}
+}
+
 // GetEntryByName Returns an entry the the name.
 func (config *Config) GetEntryByName(name string) (*Entry, error) {
 	for _, element := range config.AllowedEntries {
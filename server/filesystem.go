@@ -0,0 +1,412 @@
+package server
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/VoycerAG/gridfs-image-server/server/paint"
+)
+
+const (
+	//metaSuffix is appended to an image path to get the path of its sidecar metadata file
+	metaSuffix = ".meta.json"
+)
+
+//FilesystemStorage serves originals from a directory tree and
+//stores resized images in a separate cache directory.
+//Every namespace is a subdirectory of Root, a bucket is a subdirectory of the database. Resized images are stored
+//beneath CacheRoot/namespace/originalFilename/ along with a sidecar file
+//that contains their metadata.
+type FilesystemStorage struct {
+	Root      string
+	CacheRoot string
+}
+
+//NewFilesystemStorage returns a new filesystem storage provider
+//if cacheRoot is empty, a sibling directory of root with the suffix "-cache" will be used
+func NewFilesystemStorage(root, cacheRoot string) (Storage, error) {
+	if root == "" {
+		return nil, errors.New("root directory must be set")
+	}
+
+	root = filepath.Clean(root)
+	if cacheRoot == "" {
+		cacheRoot = root + "-cache"
+	}
+
+	fi, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", root)
+	}
+
+	return &FilesystemStorage{Root: root, CacheRoot: filepath.Clean(cacheRoot)}, nil
+}
+
+type fileCacheable struct {
+	fp   *os.File
+	info os.FileInfo
+	id   string
+	meta map[string]interface{}
+}
+
+func (fc fileCacheable) LastModified() time.Time {
+	return fc.info.ModTime()
+}
+
+//CacheIdentifier is derived from modification time and size, so
+//it is not necessary to read the whole file for every request
+func (fc fileCacheable) CacheIdentifier() string {
+	hash := md5.New()
+	fmt.Fprintf(hash, "%s-%d-%d", fc.id, fc.info.ModTime().UnixNano(), fc.info.Size())
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func (fc fileCacheable) Name() string {
+	return fc.info.Name()
+}
+
+func (fc fileCacheable) Data() ReadSeekCloser {
+	return fc.fp
+}
+
+func (fc fileCacheable) Meta() map[string]interface{} {
+	if fc.meta == nil {
+		return map[string]interface{}{}
+	}
+
+	return fc.meta
+}
+
+//implement `Identity` interface
+func (fc fileCacheable) ID() interface{} {
+	return fc.id
+}
+
+//IsValidID will always return false, files can only be found by their filename
+func (f FilesystemStorage) IsValidID(id string) bool {
+	return false
+}
+
+//FindImageByParentID behaves like FindImageByParentFilename, because the id of a file is its name
+func (f FilesystemStorage) FindImageByParentID(namespace, id string, entry *Entry) (Cacheable, error) {
+	return f.FindImageByParentFilename(namespace, id, entry)
+}
+
+//FindImageByParentFilename returns either the resized image that actually exists, or the original if entry is nil
+func (f FilesystemStorage) FindImageByParentFilename(namespace, filename string, entry *Entry) (Cacheable, error) {
+	if !isSafeNamespace(namespace) || !isSafePathElement(filename) {
+		return nil, fmt.Errorf("invalid namespace %s or filename %s", namespace, filename)
+	}
+
+	var path, id string
+	if entry == nil {
+		path = filepath.Join(f.Root, filepath.FromSlash(namespace), filename)
+		id = filename
+	} else {
+		path = filepath.Join(f.CacheRoot, filepath.FromSlash(namespace), filename, entry.childKey())
+		id = filepath.Join(filename, entry.childKey())
+	}
+
+	cacheable, err := openFileCacheable(path, id)
+	if err != nil {
+		return nil, fmt.Errorf("no image found for filename %s", filename)
+	}
+
+	return cacheable, nil
+}
+
+//StoreImage will create or replace an original image
+func (f FilesystemStorage) StoreImage(
+	namespace,
+	filename,
+	contentType string,
+	reader io.Reader,
+	metadata map[string]interface{},
+) (Cacheable, error) {
+	if !isSafeNamespace(namespace) || !isSafePathElement(filename) {
+		return nil, fmt.Errorf("invalid namespace %s or filename %s", namespace, filename)
+	}
+
+	directory := filepath.Join(f.Root, filepath.FromSlash(namespace))
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return nil, err
+	}
+
+	meta := map[string]interface{}{"contentType": contentType}
+	for k, v := range metadata {
+		meta[k] = v
+	}
+
+	encodedMeta, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(directory, filename)
+	if err := writeFileAtomic(path, reader); err != nil {
+		return nil, err
+	}
+
+	if err := writeFileAtomic(path+metaSuffix, bytes.NewReader(encodedMeta)); err != nil {
+		return nil, err
+	}
+
+	return openFileCacheable(path, filename)
+}
+
+//StoreChildImage will create a new image from source in the cache directory
+func (f FilesystemStorage) StoreChildImage(
+	database,
+	imageFormat string,
+	reader io.Reader,
+	imageWidth,
+	imageHeight int,
+	original Cacheable,
+	entry *Entry,
+) (Cacheable, error) {
+	if !isSafeNamespace(database) || !isSafePathElement(original.Name()) {
+		return nil, fmt.Errorf("invalid namespace %s or filename %s", database, original.Name())
+	}
+
+	directory := filepath.Join(f.CacheRoot, filepath.FromSlash(database), original.Name())
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return nil, err
+	}
+
+	metadata := childMetadata(imageWidth, imageHeight, original, entry)
+	metadata["contentType"] = "image/" + imageFormat
+
+	path := filepath.Join(directory, entry.childKey())
+	if err := writeFileAtomic(path, reader); err != nil {
+		log.Printf("Error for filename %s with size %dx%d\n", original.Name(), entry.Width, entry.Height)
+		return nil, err
+	}
+
+	encodedMeta, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeFileAtomic(path+metaSuffix, bytes.NewReader(encodedMeta)); err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+
+	return openFileCacheable(path, filepath.Join(original.Name(), entry.childKey()))
+}
+
+//UpdateMeta sets the given metadata keys in the sidecar file of the original, other keys are kept
+func (f FilesystemStorage) UpdateMeta(namespace string, original Cacheable, meta map[string]interface{}) error {
+	if !isSafeNamespace(namespace) || !isSafePathElement(original.Name()) {
+		return fmt.Errorf("invalid namespace %s or filename %s", namespace, original.Name())
+	}
+
+	path := filepath.Join(f.Root, filepath.FromSlash(namespace), original.Name()) + metaSuffix
+	metadata := map[string]interface{}{}
+	if encodedMeta, err := ioutil.ReadFile(path); err == nil {
+		if err := json.Unmarshal(encodedMeta, &metadata); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	for k, v := range meta {
+		metadata[k] = v
+	}
+
+	encodedMeta, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, bytes.NewReader(encodedMeta))
+}
+
+//DeleteImage removes the original with the given filename, its sidecar file
+//and the cache directory that contains all of its resized images
+func (f FilesystemStorage) DeleteImage(namespace, filename string) (int, error) {
+	if !isSafeNamespace(namespace) || !isSafePathElement(filename) {
+		return 0, fmt.Errorf("invalid namespace %s or filename %s", namespace, filename)
+	}
+
+	path := filepath.Join(f.Root, filepath.FromSlash(namespace), filename)
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	if info.IsDir() {
+		return 0, fmt.Errorf("%s is a directory", path)
+	}
+
+	removed := 0
+	directory := filepath.Join(f.CacheRoot, filepath.FromSlash(namespace), filename)
+	children, err := ioutil.ReadDir(directory)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	for _, child := range children {
+		if !child.IsDir() && isSafePathElement(child.Name()) {
+			removed++
+		}
+	}
+
+	if err := os.RemoveAll(directory); err != nil {
+		return 0, err
+	}
+
+	if err := os.Remove(path); err != nil {
+		return removed, err
+	}
+
+	if err := os.Remove(path + metaSuffix); err != nil && !os.IsNotExist(err) {
+		return removed + 1, err
+	}
+
+	return removed + 1, nil
+}
+
+//childMetadata returns the metadata of a resized image. It contains the fingerprint of the original,
+//so outdated resized images can be detected. Metadata of the original will be inherited, if the original implements `MetaContainer`
+func childMetadata(imageWidth, imageHeight int, original Cacheable, entry *Entry) map[string]interface{} {
+	metadata := map[string]interface{}{
+		"width":              imageWidth,
+		"height":             imageHeight,
+		"originalFilename":   original.Name(),
+		"originalMD5":        original.CacheIdentifier(),
+		"originalUploadDate": original.LastModified(),
+		"resizeType":         entry.Type,
+		"size":               fmt.Sprintf("%dx%d", entry.Width, entry.Height)}
+
+	if entry.Format != "" {
+		metadata["format"] = entry.Format
+	}
+
+	if entry.optionsKey() != "" {
+		metadata["options"] = entry.optionsKey()
+	}
+
+	if identifier, ok := original.(Identity); ok {
+		metadata["original"] = identifier.ID()
+	}
+
+	if metaContainer, ok := original.(MetaContainer); ok {
+		for k, v := range metaContainer.Meta() {
+			// faces are only valid in the coordinates of the original
+			if paint.IsFacesKey(k) {
+				continue
+			}
+
+			if _, exists := metadata[k]; !exists {
+				metadata[k] = v
+			}
+		}
+	}
+
+	return metadata
+}
+
+//openFileCacheable opens the file at path together with its optional sidecar metadata
+func openFileCacheable(path, id string) (*fileCacheable, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := fp.Stat()
+	if err != nil {
+		fp.Close()
+		return nil, err
+	}
+
+	if info.IsDir() {
+		fp.Close()
+		return nil, fmt.Errorf("%s is a directory", path)
+	}
+
+	meta := map[string]interface{}{}
+	if encodedMeta, err := ioutil.ReadFile(path + metaSuffix); err == nil {
+		if err := json.Unmarshal(encodedMeta, &meta); err != nil {
+			log.Printf("Invalid metadata for %s: %s\n", path, err.Error())
+		}
+	}
+
+	return &fileCacheable{fp: fp, info: info, id: id, meta: meta}, nil
+}
+
+//writeFileAtomic writes into a temporary file first, so that
+//concurrent readers will never see partially written files
+func writeFileAtomic(path string, reader io.Reader) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tmp, reader)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return nil
+}
+
+//isSafeNamespace returns true for a database or database/bucket that only consists of safe path elements
+func isSafeNamespace(namespace string) bool {
+	elements := strings.Split(namespace, "/")
+	if len(elements) > 2 {
+		return false
+	}
+
+	for _, element := range elements {
+		if !isSafePathElement(element) {
+			return false
+		}
+	}
+
+	return true
+}
+
+//isSafePathElement returns false for everything that could be
+//used to escape the configured directories
+func isSafePathElement(element string) bool {
+	if element == "" || element == "." || element == ".." {
+		return false
+	}
+
+	if strings.HasSuffix(element, metaSuffix) {
+		return false
+	}
+
+	return !strings.ContainsAny(element, `/\`) && !strings.HasPrefix(element, ".tmp-")
+}
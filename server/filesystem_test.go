@@ -0,0 +1,110 @@
+package server_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/VoycerAG/gridfs-image-server/server"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Filesystem storage", func() {
+	var (
+		root    string
+		storage Storage
+		entry   *Entry
+	)
+
+	BeforeEach(func() {
+		var err error
+		root, err = ioutil.TempDir("", "filesystem-storage")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(os.MkdirAll(filepath.Join(root, "images", "testdb"), 0755)).To(Succeed())
+
+		source, err := ioutil.ReadFile("./testdata/image.jpg")
+		Expect(err).ToNot(HaveOccurred())
+		err = ioutil.WriteFile(filepath.Join(root, "images", "testdb", "test.jpg"), source, 0644)
+		Expect(err).ToNot(HaveOccurred())
+		err = ioutil.WriteFile(filepath.Join(root, "images", "testdb", "test.jpg.meta.json"), []byte(`{"copyright": "ACME Fantasia"}`), 0644)
+		Expect(err).ToNot(HaveOccurred())
+
+		storage, err = NewFilesystemStorage(filepath.Join(root, "images"), "")
+		Expect(err).ToNot(HaveOccurred())
+		entry = &Entry{Name: "45x35", Width: 45, Height: 35, Type: "resize"}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(root)
+	})
+
+	It("will find the original by its filename", func() {
+		original, err := storage.FindImageByParentFilename("testdb", "test.jpg", nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(original.Name()).To(Equal("test.jpg"))
+		Expect(original.CacheIdentifier()).ToNot(Equal(""))
+		Expect(original.(MetaContainer).Meta()).To(HaveKeyWithValue("copyright", "ACME Fantasia"))
+	})
+
+	It("will not leave the root directory", func() {
+		_, err := storage.FindImageByParentFilename("..", "images", nil)
+		Expect(err).To(HaveOccurred())
+		_, err = storage.FindImageByParentFilename("testdb", "..", nil)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("will store and find resized images in the cache directory", func() {
+		original, err := storage.FindImageByParentFilename("testdb", "test.jpg", nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		_, err = storage.FindImageByParentFilename("testdb", "test.jpg", entry)
+		Expect(err).To(HaveOccurred())
+
+		child, err := storage.StoreChildImage("testdb", "jpeg", bytes.NewReader([]byte("resized")), 45, 35, original, entry)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(child.(Identity).ID()).ToNot(Equal(original.(Identity).ID()))
+
+		found, err := storage.FindImageByParentFilename("testdb", "test.jpg", entry)
+		Expect(err).ToNot(HaveOccurred())
+		data, err := ioutil.ReadAll(io.Reader(found.Data()))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(Equal("resized"))
+
+		meta := found.(MetaContainer).Meta()
+		Expect(meta).To(HaveKeyWithValue("originalFilename", "test.jpg"))
+		Expect(meta).To(HaveKeyWithValue("size", "45x35"))
+		Expect(meta).To(HaveKeyWithValue("resizeType", "resize"))
+		Expect(meta).To(HaveKeyWithValue("copyright", "ACME Fantasia"))
+
+		_, err = os.Stat(filepath.Join(root, "images-cache", "testdb", "test.jpg"))
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("will delete the original, its metadata and all resized images", func() {
+		original, err := storage.FindImageByParentFilename("testdb", "test.jpg", nil)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = storage.StoreChildImage("testdb", "jpeg", bytes.NewReader([]byte("resized")), 45, 35, original, entry)
+		Expect(err).ToNot(HaveOccurred())
+
+		removed, err := storage.DeleteImage("testdb", "test.jpg")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(removed).To(Equal(2))
+
+		for _, path := range []string{
+			filepath.Join(root, "images", "testdb", "test.jpg"),
+			filepath.Join(root, "images", "testdb", "test.jpg.meta.json"),
+			filepath.Join(root, "images-cache", "testdb", "test.jpg"),
+		} {
+			_, err = os.Stat(path)
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		}
+
+		removed, err = storage.DeleteImage("testdb", "test.jpg")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(removed).To(Equal(0))
+	})
+})
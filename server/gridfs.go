@@ -1,27 +1,42 @@
 package server
 
 import (
-	"crypto/sha256"
+	"crypto/rand"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"strings"
 	"time"
 
+	"github.com/VoycerAG/gridfs-image-server/server/paint"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
+const (
+	//DefaultPrefix is the gridfs prefix that will be used if no prefix is configured
+	DefaultPrefix = "fs"
+)
+
 //GridfsStorage will be made private
+//Prefix is the gridfs prefix of originals if the namespace does not contain one, DefaultPrefix if empty.
+//ChildPrefix is the gridfs prefix where resized images are stored, if empty they will be stored
+//next to their original
 type GridfsStorage struct {
-	Connection *mgo.Session
+	Connection  *mgo.Session
+	Prefix      string
+	ChildPrefix string
 }
 
 //Storage interface can be implemented
 //to use the image server with any backend you like
+//a namespace is either a database, or a database followed by a bucket separated by a slash, e.g. "database/bucket"
 type Storage interface {
+	StoreImage(namespace, filename, contentType string, imageData io.Reader, metadata map[string]interface{}) (Cacheable, error)
 	StoreChildImage(database, imageFormat string, imageData io.Reader, imageWidth, imageHeight int, original Cacheable, entry *Entry) (Cacheable, error)
+	DeleteImage(namespace, filenameOrID string) (int, error)
 	FindImageByParentID(namespace, id string, entry *Entry) (Cacheable, error)
 	FindImageByParentFilename(namespace, filename string, entry *Entry) (Cacheable, error)
 	IsValidID(id string) bool
@@ -36,6 +51,16 @@ func NewGridfsStorage(con *mgo.Session) (Storage, error) {
 	return &GridfsStorage{Connection: con}, nil
 }
 
+//NewGridfsStorageWithPrefix returns a new gridfs storage provider which uses prefix for originals
+//and stores resized images with childPrefix. An empty childPrefix will store resized images next to their originals
+func NewGridfsStorageWithPrefix(con *mgo.Session, prefix, childPrefix string) (Storage, error) {
+	if con == nil {
+		return nil, errors.New("mgo.Session must be set")
+	}
+
+	return &GridfsStorage{Connection: con, Prefix: prefix, ChildPrefix: childPrefix}, nil
+}
+
 //Cacheable is an interface for caching
 type Cacheable interface {
 	CacheIdentifier() string
@@ -56,6 +81,18 @@ type MetaContainer interface {
 	Meta() map[string]interface{}
 }
 
+//Deduplicator is an optional interface for storages that
+//can remove resized images that have been stored multiple times
+type Deduplicator interface {
+	RemoveDuplicates(namespace string) (int, error)
+}
+
+//MetaUpdater is an optional interface for storages that
+//can add metadata to an existing original, e.g. to cache the detected faces
+type MetaUpdater interface {
+	UpdateMeta(namespace string, original Cacheable, meta map[string]interface{}) error
+}
+
 //Identity returns a unique identifer for its implementor
 type Identity interface {
 	ID() interface{}
@@ -100,9 +137,38 @@ func (g GridfsStorage) IsValidID(id string) bool {
 	return bson.IsObjectIdHex(id)
 }
 
+//prefixes returns the database, the prefix of originals and the prefix of resized images of the namespace
+func (g GridfsStorage) prefixes(namespace string) (string, string, string) {
+	database, prefix := namespace, g.Prefix
+	if i := strings.Index(namespace, "/"); i >= 0 {
+		database, prefix = namespace[:i], namespace[i+1:]
+	}
+
+	if prefix == "" {
+		prefix = DefaultPrefix
+	}
+
+	childPrefix := g.ChildPrefix
+	if childPrefix == "" {
+		childPrefix = prefix
+	}
+
+	return database, prefix, childPrefix
+}
+
+//gridFS returns the gridfs of resized images if child is true, the gridfs of originals otherwise
+func (g GridfsStorage) gridFS(con *mgo.Session, namespace string, child bool) *mgo.GridFS {
+	database, prefix, childPrefix := g.prefixes(namespace)
+	if child {
+		prefix = childPrefix
+	}
+
+	return con.DB(database).GridFS(prefix)
+}
+
 //FindImageByParentID returns either the resized image that actually exists, or the original if entry is nil
 func (g GridfsStorage) FindImageByParentID(namespace, id string, entry *Entry) (Cacheable, error) {
-	gridfs := g.Connection.DB(namespace).GridFS("fs")
+	gridfs := g.gridFS(g.Connection, namespace, entry != nil)
 	var fp *mgo.GridFile
 	var query bson.M
 
@@ -110,12 +176,16 @@ func (g GridfsStorage) FindImageByParentID(namespace, id string, entry *Entry) (
 		query = bson.M{"_id": bson.ObjectIdHex(id)}
 	} else {
 		query = bson.M{
-			"metadata.original.$id": bson.ObjectIdHex(id),
-			"metadata.size":         fmt.Sprintf("%dx%d", entry.Width, entry.Height),
-			"metadata.resizeType":   entry.Type}
+			"metadata.original.$id":  bson.ObjectIdHex(id),
+			"metadata.original.$ref": g.originalQuery(namespace),
+			"metadata.size":          fmt.Sprintf("%dx%d", entry.Width, entry.Height),
+			"metadata.resizeType":    entry.Type,
+			"metadata.format":        formatQuery(entry),
+			"metadata.options":       optionsQuery(entry)}
 	}
 
-	iter := gridfs.Find(query).Iter()
+	// outdated resized images might still exist, the latest one wins
+	iter := gridfs.Find(query).Sort("-uploadDate").Iter()
 	gridfs.OpenNext(iter, &fp)
 
 	if fp == nil {
@@ -128,7 +198,7 @@ func (g GridfsStorage) FindImageByParentID(namespace, id string, entry *Entry) (
 
 // FindImageByParentFilename returns either the resized image that actually exists, or the original if entry is nil
 func (g GridfsStorage) FindImageByParentFilename(namespace, filename string, entry *Entry) (Cacheable, error) {
-	gridfs := g.Connection.DB(namespace).GridFS("fs")
+	gridfs := g.gridFS(g.Connection, namespace, entry != nil)
 	var fp *mgo.GridFile
 	var query bson.M
 
@@ -137,11 +207,16 @@ func (g GridfsStorage) FindImageByParentFilename(namespace, filename string, ent
 	} else {
 		query = bson.M{
 			"metadata.originalFilename": filename,
+			"metadata.original.$ref":    g.originalQuery(namespace),
 			"metadata.size":             fmt.Sprintf("%dx%d", entry.Width, entry.Height),
-			"metadata.resizeType":       entry.Type}
+			"metadata.resizeType":       entry.Type,
+			"metadata.format":           formatQuery(entry),
+			"metadata.options":          optionsQuery(entry)}
 	}
 
-	iter := gridfs.Find(query).Iter()
+	// if an original got uploaded multiple times, the latest upload wins.
+	// the same applies to resized images of replaced originals
+	iter := gridfs.Find(query).Sort("-uploadDate").Iter()
 	gridfs.OpenNext(iter, &fp)
 	if fp == nil {
 		return nil, fmt.Errorf("no image found for filename %s", filename)
@@ -150,13 +225,87 @@ func (g GridfsStorage) FindImageByParentFilename(namespace, filename string, ent
 	return &gridFileCacheable{mf: fp}, nil
 }
 
+//originalQuery matches resized images of originals in the collection of the namespace,
+//because resized images of all buckets might share a single collection.
+//Resized images of older versions have no reference to their original, but they
+//can only belong to originals without bucket
+func (g GridfsStorage) originalQuery(namespace string) interface{} {
+	_, prefix, _ := g.prefixes(namespace)
+	if strings.Contains(namespace, "/") {
+		return prefix + ".files"
+	}
+
+	return bson.M{"$in": []interface{}{prefix + ".files", nil}}
+}
+
+//formatQuery matches the output format of the entry. Resized images
+//of entries without format have been stored without format
+func formatQuery(entry *Entry) interface{} {
+	if entry.Format == "" {
+		return bson.M{"$exists": false}
+	}
+
+	return entry.Format
+}
+
+//optionsQuery matches the options of the entry. Resized images
+//of entries without options have been stored without them
+func optionsQuery(entry *Entry) interface{} {
+	if entry.optionsKey() == "" {
+		return bson.M{"$exists": false}
+	}
+
+	return entry.optionsKey()
+}
+
+//getRandomFilename returns a unique filename, uploaded originals must never overwrite each other
 func getRandomFilename(extension string) string {
-	hash := sha256.New()
-	hash.Write([]byte(fmt.Sprintf("%s", time.Now().Nanosecond())))
-	md := hash.Sum(nil)
-	mdStr := hex.EncodeToString(md)
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return fmt.Sprintf("%s.%s", bson.NewObjectId().Hex(), extension)
+	}
+
+	return fmt.Sprintf("%s.%s", hex.EncodeToString(random), extension)
+}
+
+//StoreImage will create a new original image
+func (g GridfsStorage) StoreImage(
+	namespace,
+	filename,
+	contentType string,
+	reader io.Reader,
+	metadata map[string]interface{},
+) (Cacheable, error) {
+	con := g.Connection.Copy()
+	defer con.Close()
+	con.EnsureSafe(&mgo.Safe{W: 1, J: true})
 
-	return fmt.Sprintf("%s.%s", mdStr, extension)
+	gridfs := g.gridFS(con, namespace, false)
+	targetfile, err := gridfs.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = io.Copy(targetfile, reader)
+	if err != nil {
+		log.Printf("Could not write file completely, cleaning %s\n", targetfile.Name())
+		targetfile.Abort()
+		targetfile.Close()
+		return nil, err
+	}
+
+	targetfile.SetContentType(contentType)
+	if len(metadata) > 0 {
+		targetfile.SetMeta(metadata)
+	}
+
+	// closing will write the file document, so the upload
+	// is only complete if there was no error
+	if err := targetfile.Close(); err != nil {
+		return nil, err
+	}
+
+	return &gridFileCacheable{mf: targetfile}, nil
 }
 
 //StoreChildImage will create a new image from source
@@ -173,46 +322,337 @@ func (g GridfsStorage) StoreChildImage(
 	defer con.Close()
 	con.EnsureSafe(&mgo.Safe{W: 1, J: true})
 
-	gridfs := con.DB(database).GridFS("fs")
-	targetfile, err := gridfs.Create(getRandomFilename(imageFormat))
+	_, prefix, _ := g.prefixes(database)
+	gridfs := g.gridFS(con, database, true)
+
+	// the unique index rejects resized images that other server instances have already stored
+	if err := ensureChildIndexes(gridfs); err != nil {
+		log.Printf("Could not ensure indexes for resized images: %s\n", err.Error())
+	}
+
+	// resized images reference their original by a DBRef, because resized images of all buckets might share a collection
+	metadata := bson.M(childMetadata(imageWidth, imageHeight, original, entry))
+	if identifier, ok := original.(Identity); ok {
+		metadata["original"] = mgo.DBRef{Collection: prefix + ".files", Id: identifier.ID()}
+	}
 
+	query := bson.M{
+		"metadata.originalFilename": metadata["originalFilename"],
+		"metadata.originalMD5":      metadata["originalMD5"],
+		"metadata.size":             metadata["size"],
+		"metadata.resizeType":       metadata["resizeType"],
+		"metadata.format":           formatQuery(entry),
+		"metadata.options":          optionsQuery(entry),
+	}
+
+	if ref, ok := metadata["original"].(mgo.DBRef); ok {
+		query["metadata.original.$id"] = ref.Id
+		query["metadata.original.$ref"] = ref.Collection
+	}
+
+	// resized images of an older focal point have the same fingerprint, but they are outdated.
+	// They are removed before this one is stored, because the unique index allows only one of them
+	// and the lookup could never find a resized image of a focal point that has been moved back
+	if entry.Type == paint.TypeFocus {
+		focus := focusQuery(metadata)
+		stale := bson.M{"$nor": []bson.M{focus}}
+		for k, v := range query {
+			stale[k] = v
+		}
+
+		var staleFiles []fileID
+		if err := gridfs.Files.Find(stale).Select(bson.M{"_id": 1}).All(&staleFiles); err == nil {
+			if err := removeFiles(gridfs, staleFiles); err != nil {
+				log.Printf("Could not remove resized images of an older focal point of %s: %s\n", original.Name(), err.Error())
+			}
+		}
+
+		for k, v := range focus {
+			query[k] = v
+		}
+	}
+
+	targetfile, err := gridfs.Create(getRandomFilename(imageFormat))
 	if err != nil {
 		return nil, err
 	}
 
-	defer targetfile.Close()
-
 	_, err = io.Copy(targetfile, reader)
 
 	if err != nil {
 		log.Printf("Error for filename %s with size %dx%d\n", original.Name(), entry.Width, entry.Height)
 		log.Printf("Could not write file completely, cleaning %s\n", targetfile.Name())
 		targetfile.Abort()
+		targetfile.Close()
 		return nil, err
 	}
 
-	metadata := bson.M{
-		"width":            imageWidth,
-		"height":           imageHeight,
-		"originalFilename": original.Name(),
-		"resizeType":       entry.Type,
-		"size":             fmt.Sprintf("%dx%d", entry.Width, entry.Height)}
+	targetfile.SetContentType("image/" + imageFormat)
+	targetfile.SetMeta(metadata)
 
-	if identifier, ok := original.(Identity); ok {
-		metadata["original"] = mgo.DBRef{Collection: "fs.files", Id: identifier.ID()}
+	// mgo removes the chunks of files that could not be stored
+	if err := targetfile.Close(); err != nil {
+		if !mgo.IsDup(err) {
+			return nil, err
+		}
+
+		// another server instance has already stored this resized image
+		var existing fileID
+		if findErr := gridfs.Files.Find(query).Sort("_id").Select(bson.M{"_id": 1}).One(&existing); findErr != nil {
+			return nil, err
+		}
+
+		file, err := gridfs.OpenId(existing.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		return &gridFileCacheable{mf: file}, nil
+	}
+
+	// the unique index can not be created as long as duplicates of older versions exist,
+	// without it other server instances might have stored the same resized image concurrently.
+	// only the oldest one will be kept
+	var files []fileID
+	if err := gridfs.Files.Find(query).Sort("_id").Select(bson.M{"_id": 1}).All(&files); err != nil || len(files) < 2 {
+		return &gridFileCacheable{mf: targetfile}, nil
+	}
+
+	if err := removeFiles(gridfs, files[1:]); err != nil {
+		log.Printf("Could not remove duplicates of %s: %s\n", targetfile.Name(), err.Error())
+	}
+
+	if files[0].ID == targetfile.Id() {
+		return &gridFileCacheable{mf: targetfile}, nil
+	}
+
+	oldest, err := gridfs.OpenId(files[0].ID)
+	if err != nil {
+		return nil, err
 	}
 
-	if metaContainer, ok := original.(MetaContainer); ok {
-		parentMeta := metaContainer.Meta()
-		for k, v := range parentMeta {
-			if _, exists := metadata[k]; !exists {
-				metadata[k] = v
+	return &gridFileCacheable{mf: oldest}, nil
+}
+
+//focusQuery matches the focal point that has been copied from the original into metadata,
+//resized images of originals without focal point must not have one either
+func focusQuery(metadata bson.M) bson.M {
+	query := bson.M{}
+	for _, key := range []string{paint.FocusXKey, paint.FocusYKey} {
+		field, value := "metadata."+key, interface{}(bson.M{"$exists": false})
+		for k, v := range metadata {
+			if strings.EqualFold(k, key) {
+				field, value = "metadata."+k, v
 			}
 		}
+
+		query[field] = value
 	}
 
-	targetfile.SetContentType("image/" + imageFormat)
-	targetfile.SetMeta(metadata)
+	return query
+}
 
-	return &gridFileCacheable{mf: targetfile}, nil
+//ensureChildIndexes creates the indexes that are used to look up resized images,
+//and a unique index on the fingerprint of resized images, so every resized image is only stored once.
+//It is sparse, so originals that are stored in the same collection are not indexed.
+//The unique index can only be created once all duplicates of older versions have been removed
+func ensureChildIndexes(gridfs *mgo.GridFS) error {
+	for _, key := range [][]string{
+		{"metadata.original.$id", "metadata.size", "metadata.resizeType"},
+		{"metadata.originalFilename", "metadata.original.$ref", "metadata.size", "metadata.resizeType"},
+	} {
+		if err := gridfs.Files.EnsureIndex(mgo.Index{Key: key, Background: true}); err != nil {
+			return err
+		}
+	}
+
+	return gridfs.Files.EnsureIndex(mgo.Index{
+		Key: []string{
+			"metadata.original.$ref",
+			"metadata.original.$id",
+			"metadata.originalFilename",
+			"metadata.originalMD5",
+			"metadata.size",
+			"metadata.resizeType",
+			"metadata.format",
+			"metadata.options",
+		},
+		Unique:     true,
+		Sparse:     true,
+		Background: true,
+	})
+}
+
+//fileID is used to select only the id of gridfs files
+type fileID struct {
+	ID interface{} `bson:"_id"`
+}
+
+//removeFiles removes all given files, files that have already been removed will be ignored
+func removeFiles(gridfs *mgo.GridFS, files []fileID) error {
+	for _, file := range files {
+		if err := gridfs.RemoveId(file.ID); err != nil && err != mgo.ErrNotFound {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//RemoveDuplicates removes all resized images of the namespace that have been stored more than once,
+//only the oldest of them will be kept. Of resized images of the focus type only the newest is kept,
+//because it has been created for the current focal point. Afterwards the unique index is created,
+//so no duplicates can be stored anymore. It returns the number of removed files
+func (g GridfsStorage) RemoveDuplicates(namespace string) (int, error) {
+	con := g.Connection.Copy()
+	defer con.Close()
+	con.EnsureSafe(&mgo.Safe{W: 1, J: true})
+
+	gridfs := g.gridFS(con, namespace, true)
+
+	// the metadata is decoded generically, because the keys of the focal point are copied
+	// from the original in any case
+	type child struct {
+		ID       interface{} `bson:"_id"`
+		Metadata bson.M      `bson:"metadata"`
+	}
+
+	iter := gridfs.Files.Find(bson.M{"metadata.resizeType": bson.M{"$exists": true}}).
+		Select(bson.M{"_id": 1, "metadata": 1}).
+		Sort("_id").
+		Iter()
+
+	var keys []string
+	groups := map[string][]interface{}{}
+	focus := map[string]bool{}
+	for {
+		var file child
+		if !iter.Next(&file) {
+			break
+		}
+
+		meta := file.Metadata
+		key := fmt.Sprintf("%v/%v/%v/%v/%v/%v", meta["originalFilename"], meta["originalMD5"], meta["size"],
+			meta["resizeType"], meta["format"], meta["options"])
+		if original, ok := meta["original"].(bson.M); ok {
+			key = fmt.Sprintf("%v/%v/%s", original["$ref"], original["$id"], key)
+		}
+
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], file.ID)
+		focus[key] = fmt.Sprint(meta["resizeType"]) == string(paint.TypeFocus)
+	}
+
+	if err := iter.Close(); err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, key := range keys {
+		ids := groups[key]
+		if len(ids) < 2 {
+			continue
+		}
+
+		if focus[key] {
+			ids = ids[:len(ids)-1]
+		} else {
+			ids = ids[1:]
+		}
+
+		for _, id := range ids {
+			if err := gridfs.RemoveId(id); err != nil && err != mgo.ErrNotFound {
+				return removed, err
+			}
+			removed++
+		}
+	}
+
+	return removed, ensureChildIndexes(gridfs)
+}
+
+//UpdateMeta sets the given metadata keys of the original, other keys are kept
+func (g GridfsStorage) UpdateMeta(namespace string, original Cacheable, meta map[string]interface{}) error {
+	identifier, ok := original.(Identity)
+	if !ok {
+		return fmt.Errorf("original %s has no id", original.Name())
+	}
+
+	con := g.Connection.Copy()
+	defer con.Close()
+
+	update := bson.M{}
+	for k, v := range meta {
+		update["metadata."+k] = v
+	}
+
+	return g.gridFS(con, namespace, false).Files.UpdateId(identifier.ID(), bson.M{"$set": update})
+}
+
+//DeleteImage removes the original with the given id, or all originals with the given filename.
+//All of their resized images will be removed as well. It returns the number of removed files
+func (g GridfsStorage) DeleteImage(namespace, filenameOrID string) (int, error) {
+	con := g.Connection.Copy()
+	defer con.Close()
+	con.EnsureSafe(&mgo.Safe{W: 1, J: true})
+
+	originals := g.gridFS(con, namespace, false)
+	children := g.gridFS(con, namespace, true)
+
+	query := bson.M{"filename": filenameOrID}
+	if g.IsValidID(filenameOrID) {
+		query = bson.M{"_id": bson.ObjectIdHex(filenameOrID)}
+	}
+
+	var files []struct {
+		ID       interface{} `bson:"_id"`
+		Filename string      `bson:"filename"`
+	}
+
+	if err := originals.Files.Find(query).Select(bson.M{"_id": 1, "filename": 1}).All(&files); err != nil {
+		return 0, err
+	}
+
+	if len(files) == 0 {
+		return 0, nil
+	}
+
+	ids := make([]interface{}, 0, len(files))
+	for _, file := range files {
+		ids = append(ids, file.ID)
+	}
+
+	// children of older versions might only be linked by their filename,
+	// they can only belong to originals without bucket
+	childQuery := bson.M{"metadata.original.$id": bson.M{"$in": ids}}
+	if !strings.Contains(namespace, "/") {
+		childQuery = bson.M{"$or": []bson.M{
+			childQuery,
+			{"metadata.originalFilename": files[0].Filename, "metadata.original": bson.M{"$exists": false}},
+		}}
+	}
+
+	var childIDs []fileID
+	if err := children.Files.Find(childQuery).Select(bson.M{"_id": 1}).All(&childIDs); err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, child := range childIDs {
+		if err := children.RemoveId(child.ID); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+
+	for _, id := range ids {
+		if err := originals.RemoveId(id); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+
+	return removed, nil
 }
@@ -0,0 +1,317 @@
+package server
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+//MemoryStorage keeps all images in memory. It is safe for concurrent use
+//and can be used for tests or if the image server is embedded into other programs.
+type MemoryStorage struct {
+	lock   sync.RWMutex
+	images map[string][]*memoryImage
+}
+
+type memoryImage struct {
+	id               bson.ObjectId
+	name             string
+	data             []byte
+	md5              string
+	uploadDate       time.Time
+	original         bson.ObjectId
+	originalFilename string
+	childKey         string
+
+	// metadata of originals can be updated
+	metaLock sync.RWMutex
+	meta     map[string]interface{}
+}
+
+//NewMemoryStorage returns a new, empty memory storage
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{images: map[string][]*memoryImage{}}
+}
+
+type memoryReader struct {
+	*bytes.Reader
+}
+
+func (m memoryReader) Close() error {
+	return nil
+}
+
+type memoryCacheable struct {
+	image *memoryImage
+}
+
+func (mc memoryCacheable) LastModified() time.Time {
+	return mc.image.uploadDate
+}
+
+func (mc memoryCacheable) CacheIdentifier() string {
+	return mc.image.md5
+}
+
+func (mc memoryCacheable) Name() string {
+	return mc.image.name
+}
+
+func (mc memoryCacheable) Data() ReadSeekCloser {
+	return memoryReader{bytes.NewReader(mc.image.data)}
+}
+
+func (mc memoryCacheable) Meta() map[string]interface{} {
+	mc.image.metaLock.RLock()
+	defer mc.image.metaLock.RUnlock()
+
+	result := make(map[string]interface{}, len(mc.image.meta))
+	for k, v := range mc.image.meta {
+		result[k] = v
+	}
+
+	return result
+}
+
+//implement `Identity` interface
+func (mc memoryCacheable) ID() interface{} {
+	return mc.image.id
+}
+
+//AddImage stores a new original image with the given metadata
+func (m *MemoryStorage) AddImage(namespace, filename string, data []byte, meta map[string]interface{}) Cacheable {
+	image := newMemoryImage(filename, data, meta)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.images[namespace] = append(m.images[namespace], image)
+
+	return &memoryCacheable{image: image}
+}
+
+//AddImageFromFile stores the file at path as a new original image with the given metadata
+func (m *MemoryStorage) AddImageFromFile(namespace, filename, path string, meta map[string]interface{}) (Cacheable, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.AddImage(namespace, filename, data, meta), nil
+}
+
+//Images returns all images of the namespace, originals and resized images
+func (m *MemoryStorage) Images(namespace string) []Cacheable {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	result := make([]Cacheable, 0, len(m.images[namespace]))
+	for _, image := range m.images[namespace] {
+		result = append(result, &memoryCacheable{image: image})
+	}
+
+	return result
+}
+
+//StoreImage will create a new original image
+//the content type is not stored, because it will be detected when the image is served
+func (m *MemoryStorage) StoreImage(
+	namespace,
+	filename,
+	contentType string,
+	reader io.Reader,
+	metadata map[string]interface{},
+) (Cacheable, error) {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.AddImage(namespace, filename, data, metadata), nil
+}
+
+//IsValidID will return true if id is a valid bson object id
+func (m *MemoryStorage) IsValidID(id string) bool {
+	return bson.IsObjectIdHex(id)
+}
+
+//FindImageByParentID returns either the resized image that actually exists, or the original if entry is nil
+func (m *MemoryStorage) FindImageByParentID(namespace, id string, entry *Entry) (Cacheable, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, fmt.Errorf("no image found for id %s", id)
+	}
+
+	objectID := bson.ObjectIdHex(id)
+	image := m.find(namespace, func(image *memoryImage) bool {
+		if entry == nil {
+			return image.id == objectID
+		}
+
+		return image.original == objectID && image.childKey == entry.childKey()
+	})
+
+	if image == nil {
+		return nil, fmt.Errorf("no image found for id %s", id)
+	}
+
+	return &memoryCacheable{image: image}, nil
+}
+
+//FindImageByParentFilename returns either the resized image that actually exists, or the original if entry is nil
+//if multiple images match, the latest one will be returned
+func (m *MemoryStorage) FindImageByParentFilename(namespace, filename string, entry *Entry) (Cacheable, error) {
+	image := m.find(namespace, func(image *memoryImage) bool {
+		if entry == nil {
+			return image.childKey == "" && image.name == filename
+		}
+
+		return image.originalFilename == filename && image.childKey == entry.childKey()
+	})
+
+	if image == nil {
+		return nil, fmt.Errorf("no image found for filename %s", filename)
+	}
+
+	return &memoryCacheable{image: image}, nil
+}
+
+//StoreChildImage will create a new image from source
+func (m *MemoryStorage) StoreChildImage(
+	database,
+	imageFormat string,
+	reader io.Reader,
+	imageWidth,
+	imageHeight int,
+	original Cacheable,
+	entry *Entry,
+) (Cacheable, error) {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := childMetadata(imageWidth, imageHeight, original, entry)
+	image := newMemoryImage(getRandomFilename(imageFormat), data, metadata)
+	image.originalFilename = original.Name()
+	image.childKey = entry.childKey()
+	if identifier, ok := original.(Identity); ok {
+		if id, ok := identifier.ID().(bson.ObjectId); ok {
+			image.original = id
+		}
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.images[database] = append(m.images[database], image)
+
+	return &memoryCacheable{image: image}, nil
+}
+
+//UpdateMeta sets the given metadata keys of the original, other keys are kept
+func (m *MemoryStorage) UpdateMeta(namespace string, original Cacheable, meta map[string]interface{}) error {
+	identifier, ok := original.(Identity)
+	if !ok {
+		return fmt.Errorf("original %s has no id", original.Name())
+	}
+
+	image := m.find(namespace, func(image *memoryImage) bool {
+		return image.childKey == "" && image.id == identifier.ID()
+	})
+
+	if image == nil {
+		return fmt.Errorf("no image found for id %v", identifier.ID())
+	}
+
+	image.metaLock.Lock()
+	defer image.metaLock.Unlock()
+
+	for k, v := range meta {
+		image.meta[k] = v
+	}
+
+	return nil
+}
+
+//DeleteImage removes the original with the given id, or all originals with the given filename
+//together with all of their resized images
+func (m *MemoryStorage) DeleteImage(namespace, filenameOrID string) (int, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	isOriginal := func(image *memoryImage) bool {
+		if image.childKey != "" {
+			return false
+		}
+
+		if bson.IsObjectIdHex(filenameOrID) {
+			return image.id == bson.ObjectIdHex(filenameOrID)
+		}
+
+		return image.name == filenameOrID
+	}
+
+	originals := map[bson.ObjectId]bool{}
+	filename := ""
+	for _, image := range m.images[namespace] {
+		if isOriginal(image) {
+			originals[image.id] = true
+			filename = image.name
+		}
+	}
+
+	if len(originals) == 0 {
+		return 0, nil
+	}
+
+	images := m.images[namespace]
+	remaining := make([]*memoryImage, 0, len(images))
+	for _, image := range images {
+		switch {
+		case originals[image.id]:
+		case image.childKey != "" && originals[image.original]:
+		case image.childKey != "" && image.original == "" && image.originalFilename == filename:
+		default:
+			remaining = append(remaining, image)
+		}
+	}
+
+	m.images[namespace] = remaining
+	return len(images) - len(remaining), nil
+}
+
+func (m *MemoryStorage) find(namespace string, matches func(image *memoryImage) bool) *memoryImage {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	images := m.images[namespace]
+	for i := len(images) - 1; i >= 0; i-- {
+		if matches(images[i]) {
+			return images[i]
+		}
+	}
+
+	return nil
+}
+
+func newMemoryImage(filename string, data []byte, meta map[string]interface{}) *memoryImage {
+	hash := md5.Sum(data)
+	metadata := make(map[string]interface{}, len(meta))
+	for k, v := range meta {
+		metadata[k] = v
+	}
+
+	return &memoryImage{
+		id:         bson.NewObjectId(),
+		name:       filename,
+		data:       data,
+		md5:        hex.EncodeToString(hash[:]),
+		uploadDate: time.Now(),
+		meta:       metadata,
+	}
+}
@@ -0,0 +1,798 @@
+package server_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"image/gif"
+	"image/jpeg"
+	_ "image/png"
+
+	_ "golang.org/x/image/webp"
+
+	"gopkg.in/mgo.v2/bson"
+
+	. "github.com/VoycerAG/gridfs-image-server/server"
+	"github.com/VoycerAG/gridfs-image-server/server/paint"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+//slowStorage delays the storage of resized images, so concurrent requests will overlap
+type slowStorage struct {
+	*MemoryStorage
+	stored int32
+}
+
+func (s *slowStorage) StoreChildImage(database, imageFormat string, imageData io.Reader, imageWidth, imageHeight int, original Cacheable, entry *Entry) (Cacheable, error) {
+	atomic.AddInt32(&s.stored, 1)
+	time.Sleep(50 * time.Millisecond)
+	return s.MemoryStorage.StoreChildImage(database, imageFormat, imageData, imageWidth, imageHeight, original, entry)
+}
+
+//panickingStorage panics while the resized image is stored, after concurrent requests had time to wait for it
+type panickingStorage struct {
+	*MemoryStorage
+}
+
+func (p *panickingStorage) StoreChildImage(database, imageFormat string, imageData io.Reader, imageWidth, imageHeight int, original Cacheable, entry *Entry) (Cacheable, error) {
+	time.Sleep(50 * time.Millisecond)
+	panic("storage failed")
+}
+
+//closingStorage counts how often resized images have been found and closed,
+//like gridfs files they stay open once they have been found
+type closingStorage struct {
+	*MemoryStorage
+	opened int32
+	closed int32
+}
+
+func (c *closingStorage) FindImageByParentFilename(namespace, filename string, entry *Entry) (Cacheable, error) {
+	image, err := c.MemoryStorage.FindImageByParentFilename(namespace, filename, entry)
+	if err != nil || entry == nil {
+		return image, err
+	}
+
+	atomic.AddInt32(&c.opened, 1)
+	return &closingCacheable{Cacheable: image, storage: c}, nil
+}
+
+type closingCacheable struct {
+	Cacheable
+	storage *closingStorage
+}
+
+func (c *closingCacheable) Data() ReadSeekCloser {
+	return closingReader{ReadSeekCloser: c.Cacheable.Data(), storage: c.storage}
+}
+
+func (c *closingCacheable) Meta() map[string]interface{} {
+	return c.Cacheable.(MetaContainer).Meta()
+}
+
+type closingReader struct {
+	ReadSeekCloser
+	storage *closingStorage
+}
+
+func (c closingReader) Close() error {
+	atomic.AddInt32(&c.storage.closed, 1)
+	return c.ReadSeekCloser.Close()
+}
+
+//optionsResizer records the options of the last resize
+type optionsResizer struct {
+	options paint.ResizeOptions
+}
+
+func (o *optionsResizer) Resize(input image.Image, dstWidth, dstHeight int) (image.Image, error) {
+	return o.ResizeWithOptions(input, dstWidth, dstHeight, paint.ResizeOptions{})
+}
+
+func (o *optionsResizer) ResizeWithOptions(input image.Image, dstWidth, dstHeight int, options paint.ResizeOptions) (image.Image, error) {
+	o.options = options
+	return paint.PlainResizer{}.Resize(input, dstWidth, dstHeight)
+}
+
+//faceResizer returns the same faces for every image and counts the detections
+type faceResizer struct {
+	optionsResizer
+	faces      []image.Rectangle
+	detections int32
+}
+
+func (f *faceResizer) DetectFaces(input image.Image, options paint.FaceOptions) ([]image.Rectangle, error) {
+	atomic.AddInt32(&f.detections, 1)
+	return f.faces, nil
+}
+
+var _ = Describe("Server with memory storage", func() {
+	var (
+		rec         *httptest.ResponseRecorder
+		storage     *MemoryStorage
+		imageServer Server
+		original    Cacheable
+	)
+
+	serve := func(url string, header http.Header) {
+		req, err := http.NewRequest("GET", url, nil)
+		Expect(err).ToNot(HaveOccurred())
+		for k, v := range header {
+			req.Header[k] = v
+		}
+
+		rec = httptest.NewRecorder()
+		imageServer.Handler().ServeHTTP(rec, req)
+	}
+
+	BeforeEach(func() {
+		config, err := NewConfigFromBytes([]byte(testConfig))
+		Expect(err).ToNot(HaveOccurred())
+		storage = NewMemoryStorage()
+		imageServer = NewImageServer(config, storage)
+		original, err = storage.AddImageFromFile("testdb", "test.jpg", "./testdata/image.jpg", map[string]interface{}{
+			"copyright": "ACME Fantasia",
+		})
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("will response with 404 if image not found", func() {
+		serve("/testdb/notfound.jpg", nil)
+		Expect(rec.Code).To(Equal(http.StatusNotFound))
+		serve("/otherdb/test.jpg", nil)
+		Expect(rec.Code).To(Equal(http.StatusNotFound))
+	})
+
+	It("will deliver the original image without filter", func() {
+		serve("/testdb/test.jpg", nil)
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(rec.Header().Get("Etag")).To(Equal(original.CacheIdentifier()))
+		Expect(storage.Images("testdb")).To(HaveLen(1))
+	})
+
+	It("will deliver the original image by its id", func() {
+		id := original.(Identity).ID().(bson.ObjectId)
+		serve("/testdb/"+id.Hex(), nil)
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(rec.Header().Get("Etag")).To(Equal(original.CacheIdentifier()))
+	})
+
+	It("will resize the image once and store it as child", func() {
+		serve("/testdb/test.jpg?size=45x35", nil)
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		resized, err := jpeg.Decode(bytes.NewReader(rec.Body.Bytes()))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(resized.Bounds()).To(Equal(image.Rect(0, 0, 45, 35)))
+		Expect(storage.Images("testdb")).To(HaveLen(2))
+		etag := rec.Header().Get("Etag")
+
+		serve("/testdb/test.jpg?size=45x35", nil)
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(rec.Header().Get("Etag")).To(Equal(etag))
+		Expect(storage.Images("testdb")).To(HaveLen(2))
+
+		id := original.(Identity).ID().(bson.ObjectId)
+		serve("/testdb/"+id.Hex()+"?size=45x35", nil)
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(rec.Header().Get("Etag")).To(Equal(etag))
+		Expect(storage.Images("testdb")).To(HaveLen(2))
+	})
+
+	It("will regenerate resized images of replaced originals", func() {
+		serve("/testdb/test.jpg?size=45x35", nil)
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		etag := rec.Header().Get("Etag")
+
+		replacement, err := storage.AddImageFromFile("testdb", "test.jpg", "./testdata/normal.png", nil)
+		Expect(err).ToNot(HaveOccurred())
+		serve("/testdb/test.jpg?size=45x35", nil)
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(rec.Header().Get("Etag")).ToNot(Equal(etag))
+		Expect(storage.Images("testdb")).To(HaveLen(4))
+
+		child, err := storage.FindImageByParentFilename("testdb", "test.jpg", &Entry{Width: 45, Height: 35, Type: "resize"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(child.(MetaContainer).Meta()).To(HaveKeyWithValue("originalMD5", replacement.CacheIdentifier()))
+
+		serve("/testdb/test.jpg?size=45x35", nil)
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(storage.Images("testdb")).To(HaveLen(4))
+	})
+
+	It("will close outdated resized images", func() {
+		config, err := NewConfigFromBytes([]byte(testConfig))
+		Expect(err).ToNot(HaveOccurred())
+		closing := &closingStorage{MemoryStorage: storage}
+		imageServer = NewImageServer(config, closing)
+
+		serve("/testdb/test.jpg?size=45x35", nil)
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		_, err = storage.AddImageFromFile("testdb", "test.jpg", "./testdata/normal.png", nil)
+		Expect(err).ToNot(HaveOccurred())
+		serve("/testdb/test.jpg?size=45x35", nil)
+		Expect(rec.Code).To(Equal(http.StatusOK))
+
+		Expect(atomic.LoadInt32(&closing.opened)).To(BeNumerically(">", 0))
+		Expect(atomic.LoadInt32(&closing.closed)).To(Equal(atomic.LoadInt32(&closing.opened)))
+	})
+
+	It("will resize only once for concurrent requests", func() {
+		config, err := NewConfigFromBytes([]byte(testConfig))
+		Expect(err).ToNot(HaveOccurred())
+		slow := &slowStorage{MemoryStorage: storage}
+		imageServer = NewImageServer(config, slow)
+
+		var wg sync.WaitGroup
+		recorders := make([]*httptest.ResponseRecorder, 10)
+		for i := range recorders {
+			recorders[i] = httptest.NewRecorder()
+			wg.Add(1)
+			go func(rec *httptest.ResponseRecorder) {
+				defer GinkgoRecover()
+				defer wg.Done()
+				req, err := http.NewRequest("GET", "/testdb/test.jpg?size=45x35", nil)
+				Expect(err).ToNot(HaveOccurred())
+				imageServer.Handler().ServeHTTP(rec, req)
+			}(recorders[i])
+		}
+		wg.Wait()
+
+		Expect(atomic.LoadInt32(&slow.stored)).To(Equal(int32(1)))
+		Expect(storage.Images("testdb")).To(HaveLen(2))
+		for _, rec := range recorders {
+			Expect(rec.Code).To(Equal(http.StatusOK))
+			Expect(rec.Body.Bytes()).To(Equal(recorders[0].Body.Bytes()))
+		}
+
+		serve("/testdb/test.jpg?size=45x35", nil)
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(atomic.LoadInt32(&slow.stored)).To(Equal(int32(1)))
+	})
+
+	It("will respond with an error to concurrent requests if the resize panics", func() {
+		config, err := NewConfigFromBytes([]byte(testConfig))
+		Expect(err).ToNot(HaveOccurred())
+		imageServer = NewImageServer(config, &panickingStorage{MemoryStorage: storage})
+
+		var wg sync.WaitGroup
+		var panics int32
+		recorders := make([]*httptest.ResponseRecorder, 10)
+		for i := range recorders {
+			recorders[i] = httptest.NewRecorder()
+			wg.Add(1)
+			go func(rec *httptest.ResponseRecorder) {
+				defer GinkgoRecover()
+				defer wg.Done()
+				defer func() {
+					if recover() != nil {
+						atomic.AddInt32(&panics, 1)
+					}
+				}()
+
+				req, err := http.NewRequest("GET", "/testdb/test.jpg?size=45x35", nil)
+				Expect(err).ToNot(HaveOccurred())
+				imageServer.Handler().ServeHTTP(rec, req)
+			}(recorders[i])
+		}
+		wg.Wait()
+
+		Expect(atomic.LoadInt32(&panics)).To(Equal(int32(1)))
+		errors := 0
+		for _, rec := range recorders {
+			if rec.Code == http.StatusInternalServerError {
+				errors++
+			}
+		}
+		Expect(errors).To(Equal(len(recorders) - 1))
+	})
+
+	It("will not decode images that exceed the limits", func() {
+		config, err := NewConfigFromBytes([]byte(`{
+			"limits" : { "maxWidth" : 100 },
+			"allowedEntries" : [ { "name" : "45x35", "width" : 45, "height" : 35, "type" : "resize" } ]
+		}`))
+		Expect(err).ToNot(HaveOccurred())
+		imageServer = NewImageServer(config, storage)
+
+		serve("/testdb/test.jpg?size=45x35", nil)
+		Expect(rec.Code).To(Equal(422))
+		Expect(storage.Images("testdb")).To(HaveLen(1))
+
+		serve("/testdb/test.jpg", nil)
+		Expect(rec.Code).To(Equal(http.StatusOK))
+	})
+
+	It("will convert resized images into the format of the entry", func() {
+		config, err := NewConfigFromBytes([]byte(`{
+			"allowedEntries" : [
+				{ "name" : "original", "width" : 45, "height" : 35, "type" : "resize" },
+				{ "name" : "png", "width" : 45, "height" : 35, "type" : "resize", "format" : "png" },
+				{ "name" : "auto", "width" : 45, "height" : 35, "type" : "resize", "format" : "auto" }
+			]
+		}`))
+		Expect(err).ToNot(HaveOccurred())
+		imageServer = NewImageServer(config, storage)
+
+		for size, expectedFormat := range map[string]string{"original": "jpeg", "png": "png", "auto": "jpeg"} {
+			serve("/testdb/test.jpg?size="+size, nil)
+			Expect(rec.Code).To(Equal(http.StatusOK))
+			_, format, err := image.DecodeConfig(bytes.NewReader(rec.Body.Bytes()))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(format).To(Equal(expectedFormat))
+		}
+
+		Expect(storage.Images("testdb")).To(HaveLen(4))
+		child, err := storage.FindImageByParentFilename("testdb", "test.jpg", &Entry{Width: 45, Height: 35, Type: "resize", Format: "png"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(child.Name()).To(HaveSuffix(".png"))
+		Expect(child.(MetaContainer).Meta()).To(HaveKeyWithValue("format", "png"))
+	})
+
+	It("will negotiate the format of resized images if enabled", func() {
+		serve("/testdb/test.jpg?size=45x35", http.Header{"Accept": {"image/webp"}})
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(rec.Header().Get("Vary")).To(Equal(""))
+
+		config, err := NewConfigFromBytes([]byte(`{
+			"acceptNegotiation" : true,
+			"allowedEntries" : [ { "name" : "45x35", "width" : 45, "height" : 35, "type" : "resize" } ]
+		}`))
+		Expect(err).ToNot(HaveOccurred())
+		imageServer = NewImageServer(config, storage)
+
+		// every format is stored as separate resized image
+		expectedFormat, expectedImages := "jpeg", 2
+		if paint.CanEncode("webp") {
+			expectedFormat, expectedImages = "webp", 3
+		}
+
+		for accept, expected := range map[string]string{
+			"image/webp,image/*;q=0.8": expectedFormat,
+			"image/webp;q=0":           "jpeg",
+			"*/*":                      "jpeg",
+		} {
+			serve("/testdb/test.jpg?size=45x35", http.Header{"Accept": {accept}})
+			Expect(rec.Code).To(Equal(http.StatusOK))
+			Expect(rec.Header().Get("Vary")).To(Equal("Accept"))
+			_, format, err := image.DecodeConfig(bytes.NewReader(rec.Body.Bytes()))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(format).To(Equal(expected), accept)
+		}
+
+		Expect(storage.Images("testdb")).To(HaveLen(expectedImages))
+	})
+
+	It("will reject entries with unknown formats or invalid encoding options", func() {
+		for _, entry := range []string{
+			`{ "name" : "bmp", "width" : 45, "height" : 35, "type" : "resize", "format" : "bmp" }`,
+			`{ "name" : "quality", "width" : 45, "height" : 35, "type" : "resize", "quality" : 101 }`,
+			`{ "name" : "compression", "width" : 45, "height" : 35, "type" : "resize", "pngCompression" : "maximum" }`,
+			`{ "name" : "metadata", "width" : 45, "height" : 35, "type" : "resize", "metadata" : "all" }`,
+			`{ "name" : "pad", "width" : 45, "height" : -1, "type" : "pad" }`,
+			`{ "name" : "background", "width" : 45, "height" : 35, "type" : "pad", "background" : "blue" }`,
+			`{ "name" : "transparent", "width" : 45, "height" : 35, "type" : "pad", "background" : "transparent", "format" : "jpeg" }`,
+			`{ "name" : "alpha", "width" : 45, "height" : 35, "type" : "pad", "background" : "#00000080" }`,
+			`{ "name" : "alignment", "width" : 45, "height" : 35, "type" : "pad", "alignment" : "middle" }`,
+			`{ "name" : "faces", "width" : 45, "height" : 35, "type" : "crop", "minFaceArea" : 1.5 }`,
+			`{ "name" : "padding", "width" : 45, "height" : 35, "type" : "crop", "facePadding" : -0.5 }`,
+			`{ "name" : "fallback", "width" : 45, "height" : 35, "type" : "crop", "fallback" : "magic" }`,
+			`{ "name" : "recursion", "width" : 45, "height" : 35, "type" : "crop", "fallback" : "crop" }`,
+		} {
+			_, err := NewConfigFromBytes([]byte(`{ "allowedEntries" : [ ` + entry + ` ] }`))
+			Expect(err).To(HaveOccurred(), entry)
+		}
+
+		_, err := NewConfigFromBytes([]byte(`{ "allowedEntries" : [
+			{ "name" : "transparent", "width" : 45, "height" : 35, "type" : "pad", "background" : "transparent", "format" : "png" },
+			{ "name" : "alpha", "width" : 45, "height" : 35, "type" : "pad", "background" : "#00000080", "format" : "auto" },
+			{ "name" : "progressive", "width" : 45, "height" : 35, "type" : "resize", "progressive" : true }
+		] }`))
+		Expect(err).ToNot(HaveOccurred())
+
+		_, err = NewConfigFromBytes([]byte(`{ "allowedEntries" : [
+			{ "name" : "webp", "width" : 45, "height" : 35, "type" : "resize", "format" : "webp" }
+		] }`))
+		if paint.CanEncode("webp") {
+			Expect(err).ToNot(HaveOccurred())
+		} else {
+			Expect(err).To(HaveOccurred())
+		}
+	})
+
+	It("will encode resized images with the quality of the entry", func() {
+		config, err := NewConfigFromBytes([]byte(`{
+			"allowedEntries" : [
+				{ "name" : "hero", "width" : 200, "height" : 150, "type" : "crop", "quality" : 90 },
+				{ "name" : "avatar", "width" : 200, "height" : 150, "type" : "crop", "quality" : 60 }
+			]
+		}`))
+		Expect(err).ToNot(HaveOccurred())
+		imageServer = NewImageServer(config, storage)
+
+		serve("/testdb/test.jpg?size=hero", nil)
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		hero := rec.Body.Len()
+
+		serve("/testdb/test.jpg?size=avatar", nil)
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(rec.Body.Len()).To(BeNumerically("<", hero))
+	})
+
+	It("will share resized images of entries that set options to their default", func() {
+		config, err := NewConfigFromBytes([]byte(`{
+			"allowedEntries" : [
+				{ "name" : "plain", "width" : 50, "height" : 40, "type" : "crop" },
+				{ "name" : "defaults", "width" : 50, "height" : 40, "type" : "crop", "metadata" : "strip", "pngCompression" : "default" }
+			]
+		}`))
+		Expect(err).ToNot(HaveOccurred())
+		imageServer = NewImageServer(config, storage)
+
+		serve("/testdb/test.jpg?size=plain", nil)
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		serve("/testdb/test.jpg?size=defaults", nil)
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(storage.Images("testdb")).To(HaveLen(2))
+	})
+
+	It("will keep animations unless the entry flattens them", func() {
+		config, err := NewConfigFromBytes([]byte(`{
+			"allowedEntries" : [
+				{ "name" : "animated", "width" : 50, "height" : 40, "type" : "crop" },
+				{ "name" : "still", "width" : 50, "height" : 40, "type" : "crop", "flatten" : true }
+			]
+		}`))
+		Expect(err).ToNot(HaveOccurred())
+		imageServer = NewImageServer(config, storage)
+		_, err = storage.AddImageFromFile("testdb", "animated.gif", "./testdata/animated.gif", nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		for size, expectedFrames := range map[string]int{"animated": 12, "still": 1} {
+			serve("/testdb/animated.gif?size="+size, nil)
+			Expect(rec.Code).To(Equal(http.StatusOK))
+			resized, err := gif.DecodeAll(bytes.NewReader(rec.Body.Bytes()))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resized.Image).To(HaveLen(expectedFrames))
+		}
+	})
+
+	It("will not negotiate the format of animations", func() {
+		config, err := NewConfigFromBytes([]byte(`{
+			"acceptNegotiation" : true,
+			"allowedEntries" : [
+				{ "name" : "animated", "width" : 50, "height" : 40, "type" : "crop" },
+				{ "name" : "still", "width" : 50, "height" : 40, "type" : "crop", "flatten" : true }
+			]
+		}`))
+		Expect(err).ToNot(HaveOccurred())
+		imageServer = NewImageServer(config, storage)
+		_, err = storage.AddImageFromFile("testdb", "animated.gif", "./testdata/animated.gif", nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		expectedFormat := "gif"
+		if paint.CanEncode("webp") {
+			expectedFormat = "webp"
+		}
+
+		for size, expected := range map[string]string{"animated": "gif", "still": expectedFormat} {
+			serve("/testdb/animated.gif?size="+size, http.Header{"Accept": {"image/webp"}})
+			Expect(rec.Code).To(Equal(http.StatusOK))
+			_, format, err := image.DecodeConfig(bytes.NewReader(rec.Body.Bytes()))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(format).To(Equal(expected), size)
+		}
+
+		// the stored animation is found again for clients that accept webp
+		serve("/testdb/animated.gif?size=animated", http.Header{"Accept": {"image/webp"}})
+		resized, err := gif.DecodeAll(bytes.NewReader(rec.Body.Bytes()))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(resized.Image).To(HaveLen(12))
+		Expect(storage.Images("testdb")).To(HaveLen(4))
+	})
+
+	It("will rotate images according to their exif orientation if the entry requests it", func() {
+		config, err := NewConfigFromBytes([]byte(`{
+			"allowedEntries" : [
+				{ "name" : "stored", "width" : 20, "height" : -1, "type" : "resize" },
+				{ "name" : "upright", "width" : 20, "height" : -1, "type" : "resize", "autoOrient" : true }
+			]
+		}`))
+		Expect(err).ToNot(HaveOccurred())
+		imageServer = NewImageServer(config, storage)
+		_, err = storage.AddImageFromFile("testdb", "rotated.jpg", "./testdata/orientation_6.jpg", nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		for size, expectedHeight := range map[string]int{"stored": 40, "upright": 10} {
+			serve("/testdb/rotated.jpg?size="+size, nil)
+			Expect(rec.Code).To(Equal(http.StatusOK))
+			resized, _, err := image.DecodeConfig(bytes.NewReader(rec.Body.Bytes()))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resized.Width).To(Equal(20))
+			Expect(resized.Height).To(Equal(expectedHeight))
+		}
+	})
+
+	It("will keep the metadata of the original according to the entry", func() {
+		config, err := NewConfigFromBytes([]byte(`{
+			"allowedEntries" : [
+				{ "name" : "stripped", "width" : 20, "height" : 15, "type" : "resize" },
+				{ "name" : "credited", "width" : 20, "height" : 15, "type" : "resize", "metadata" : "copyright" }
+			]
+		}`))
+		Expect(err).ToNot(HaveOccurred())
+		imageServer = NewImageServer(config, storage)
+		_, err = storage.AddImageFromFile("testdb", "metadata.jpg", "./testdata/metadata.jpg", nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		serve("/testdb/metadata.jpg?size=stripped", nil)
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(rec.Body.String()).ToNot(ContainSubstring("Jane Photographer"))
+
+		serve("/testdb/metadata.jpg?size=credited", nil)
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(rec.Body.String()).To(ContainSubstring("(c) 2016 Jane Photographer"))
+		Expect(rec.Body.String()).ToNot(ContainSubstring("SECRETDATUM"))
+	})
+
+	It("will pad resized images with the background of the entry", func() {
+		config, err := NewConfigFromBytes([]byte(`{
+			"allowedEntries" : [
+				{ "name" : "white", "width" : 100, "height" : 100, "type" : "pad" },
+				{ "name" : "black", "width" : 100, "height" : 100, "type" : "pad", "background" : "#000000", "alignment" : "top" }
+			]
+		}`))
+		Expect(err).ToNot(HaveOccurred())
+		imageServer = NewImageServer(config, storage)
+
+		brightness := func(img image.Image, x, y int) uint32 {
+			r, g, b, _ := img.At(x, y).RGBA()
+			return (r + g + b) / 3 >> 8
+		}
+
+		serve("/testdb/test.jpg?size=white", nil)
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		padded, format, err := image.Decode(bytes.NewReader(rec.Body.Bytes()))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(format).To(Equal("jpeg"))
+		Expect(padded.Bounds()).To(Equal(image.Rect(0, 0, 100, 100)))
+		Expect(brightness(padded, 50, 2)).To(BeNumerically(">", 240))
+
+		serve("/testdb/test.jpg?size=black", nil)
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		padded, _, err = image.Decode(bytes.NewReader(rec.Body.Bytes()))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(brightness(padded, 50, 97)).To(BeNumerically("<", 16))
+	})
+
+	It("will crop around the focal point of the original", func() {
+		config, err := NewConfigFromBytes([]byte(`{
+			"allowedEntries" : [ { "name" : "square", "width" : 50, "height" : 50, "type" : "focus" } ]
+		}`))
+		Expect(err).ToNot(HaveOccurred())
+		imageServer = NewImageServer(config, storage)
+
+		responses := map[string][]byte{}
+		for filename, focusX := range map[string]float64{"left.jpg": 0, "right.jpg": 1} {
+			_, err = storage.AddImageFromFile("testdb", filename, "./testdata/image.jpg", map[string]interface{}{"focusX": focusX, "focusY": 0.5})
+			Expect(err).ToNot(HaveOccurred())
+			serve("/testdb/"+filename+"?size=square", nil)
+			Expect(rec.Code).To(Equal(http.StatusOK))
+			responses[filename] = rec.Body.Bytes()
+		}
+
+		Expect(responses["left.jpg"]).ToNot(Equal(responses["right.jpg"]))
+
+		// moving the focal point of an original outdates its resized images
+		_, err = storage.AddImageFromFile("testdb", "left.jpg", "./testdata/image.jpg", map[string]interface{}{"focusX": 1, "focusY": 0.5})
+		Expect(err).ToNot(HaveOccurred())
+		serve("/testdb/left.jpg?size=square", nil)
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(rec.Body.Bytes()).To(Equal(responses["right.jpg"]))
+	})
+
+	It("will crop to the part with the most content without face detection", func() {
+		config, err := NewConfigFromBytes([]byte(`{
+			"allowedEntries" : [ { "name" : "salient", "width" : 50, "height" : 50, "type" : "saliency" } ]
+		}`))
+		Expect(err).ToNot(HaveOccurred())
+		imageServer = NewImageServer(config, storage)
+
+		serve("/testdb/test.jpg?size=salient", nil)
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		resized, _, err := image.DecodeConfig(bytes.NewReader(rec.Body.Bytes()))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(resized.Width).To(Equal(50))
+		Expect(resized.Height).To(Equal(50))
+	})
+
+	It("will pass the face detection options of the entry to the resizer", func() {
+		resizer := &optionsResizer{}
+		paint.AddResizer("options", resizer)
+		defer paint.RemoveResizer("options")
+		config, err := NewConfigFromBytes([]byte(`{
+			"allowedEntries" : [
+				{ "name" : "avatar", "width" : 45, "height" : 35, "type" : "options",
+				  "minFaceArea" : 0.05, "detectionSize" : 512, "facePadding" : 0, "fallback" : "pad" }
+			]
+		}`))
+		Expect(err).ToNot(HaveOccurred())
+		imageServer = NewImageServer(config, storage)
+
+		serve("/testdb/test.jpg?size=avatar", nil)
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(resizer.options.Faces.MinArea).To(Equal(0.05))
+		Expect(resizer.options.Faces.DetectionSize).To(Equal(512))
+		Expect(resizer.options.Faces.Padding).ToNot(BeNil())
+		Expect(*resizer.options.Faces.Padding).To(BeZero())
+		Expect(resizer.options.Faces.Fallback).To(Equal(paint.TypePad))
+	})
+
+	Context("Faces", func() {
+		var detector *faceResizer
+
+		BeforeEach(func() {
+			detector = &faceResizer{faces: []image.Rectangle{image.Rect(10, 20, 40, 60), image.Rect(50, 5, 60, 15)}}
+			paint.AddResizer("faces", detector)
+			config, err := NewConfigFromBytes([]byte(`{
+				"allowedEntries" : [
+					{ "name" : "small", "width" : 45, "height" : 35, "type" : "faces" },
+					{ "name" : "large", "width" : 90, "height" : 70, "type" : "faces" },
+					{ "name" : "oriented", "width" : 90, "height" : 70, "type" : "faces", "autoOrient" : true },
+					{ "name" : "detailed", "width" : 90, "height" : 70, "type" : "faces", "detectionSize" : 2048 }
+				]
+			}`))
+			Expect(err).ToNot(HaveOccurred())
+			imageServer = NewImageServer(config, storage)
+		})
+
+		AfterEach(func() {
+			paint.RemoveResizer("faces")
+			paint.SetFaceDetector(nil)
+		})
+
+		It("will respond with 501 if no face detector has been registered", func() {
+			serve("/testdb/test.jpg/faces", nil)
+			Expect(rec.Code).To(Equal(http.StatusNotImplemented))
+		})
+
+		It("will respond with 404 if the image does not exist", func() {
+			paint.SetFaceDetector(detector)
+			serve("/testdb/unknown.jpg/faces", nil)
+			Expect(rec.Code).To(Equal(http.StatusNotFound))
+		})
+
+		It("will return the faces and cache them in the metadata of the original", func() {
+			paint.SetFaceDetector(detector)
+			serve("/testdb/test.jpg/faces", nil)
+			Expect(rec.Code).To(Equal(http.StatusOK))
+			Expect(rec.Header().Get("Content-Type")).To(Equal("application/json"))
+
+			var response struct {
+				Faces []paint.Face `json:"faces"`
+			}
+			Expect(json.Unmarshal(rec.Body.Bytes(), &response)).To(Succeed())
+			Expect(response.Faces).To(Equal([]paint.Face{
+				{X: 10, Y: 20, Width: 30, Height: 40},
+				{X: 50, Y: 5, Width: 10, Height: 10},
+			}))
+
+			faces, found := paint.FacesFromMeta(original.(MetaContainer).Meta(), 0, original.CacheIdentifier())
+			Expect(found).To(BeTrue())
+			Expect(faces).To(Equal(detector.faces))
+
+			serve("/testdb/test.jpg/faces", nil)
+			Expect(rec.Code).To(Equal(http.StatusOK))
+			Expect(atomic.LoadInt32(&detector.detections)).To(Equal(int32(1)))
+		})
+
+		It("will return faces of images in buckets", func() {
+			paint.SetFaceDetector(detector)
+			storage.AddImageFromFile("testdb/avatars", "avatar.jpg", "./testdata/image.jpg", nil)
+			serve("/testdb/avatars/avatar.jpg/faces", nil)
+			Expect(rec.Code).To(Equal(http.StatusOK))
+			Expect(rec.Body.String()).To(ContainSubstring(`"width":30`))
+		})
+
+		It("will prefer the faces of an image over images named faces in buckets", func() {
+			paint.SetFaceDetector(detector)
+			storage.AddImageFromFile("testdb/test.jpg", "faces", "./testdata/image.jpg", nil)
+			serve("/testdb/test.jpg/faces", nil)
+			Expect(rec.Code).To(Equal(http.StatusOK))
+			Expect(rec.Header().Get("Content-Type")).To(Equal("application/json"))
+			Expect(atomic.LoadInt32(&detector.detections)).To(Equal(int32(1)))
+		})
+
+		It("will detect faces once for all sizes of the original", func() {
+			serve("/testdb/test.jpg?size=small", nil)
+			Expect(rec.Code).To(Equal(http.StatusOK))
+			Expect(detector.options.Faces.Detected).To(Equal(detector.faces))
+
+			serve("/testdb/test.jpg?size=large", nil)
+			Expect(rec.Code).To(Equal(http.StatusOK))
+			Expect(detector.options.Faces.Detected).To(Equal(detector.faces))
+			Expect(atomic.LoadInt32(&detector.detections)).To(Equal(int32(1)))
+
+			_, found := paint.FacesFromMeta(original.(MetaContainer).Meta(), 0, original.CacheIdentifier())
+			Expect(found).To(BeTrue())
+
+			child, err := storage.FindImageByParentFilename("testdb", "test.jpg", &Entry{Width: 45, Height: 35, Type: "faces"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(child.(MetaContainer).Meta()).ToNot(HaveKey(paint.FacesKey))
+		})
+
+		It("will detect faces again for entries with another detection size", func() {
+			serve("/testdb/test.jpg?size=small", nil)
+			Expect(rec.Code).To(Equal(http.StatusOK))
+			serve("/testdb/test.jpg?size=detailed", nil)
+			Expect(rec.Code).To(Equal(http.StatusOK))
+			Expect(atomic.LoadInt32(&detector.detections)).To(Equal(int32(2)))
+			Expect(original.(MetaContainer).Meta()).To(HaveKey(paint.FacesMetaKey(2048)))
+		})
+
+		It("will not reuse cached faces of a replaced original", func() {
+			storage.UpdateMeta("testdb", original, map[string]interface{}{
+				paint.FacesKey: paint.NewCachedFaces("replaced", []image.Rectangle{image.Rect(1, 2, 4, 6)}),
+			})
+
+			serve("/testdb/test.jpg?size=small", nil)
+			Expect(rec.Code).To(Equal(http.StatusOK))
+			Expect(detector.options.Faces.Detected).To(Equal(detector.faces))
+			Expect(atomic.LoadInt32(&detector.detections)).To(Equal(int32(1)))
+
+			faces, found := paint.FacesFromMeta(original.(MetaContainer).Meta(), 0, original.CacheIdentifier())
+			Expect(found).To(BeTrue())
+			Expect(faces).To(Equal(detector.faces))
+		})
+
+		It("will reuse cached faces, unless the image is rotated", func() {
+			storage.UpdateMeta("testdb", original, map[string]interface{}{
+				paint.FacesKey: bson.M{
+					"original": original.CacheIdentifier(),
+					"faces":    []interface{}{bson.M{"x": 1, "y": 2, "width": 3, "height": 4}},
+				},
+			})
+
+			serve("/testdb/test.jpg?size=small", nil)
+			Expect(rec.Code).To(Equal(http.StatusOK))
+			Expect(detector.options.Faces.Detected).To(Equal([]image.Rectangle{image.Rect(1, 2, 4, 6)}))
+
+			serve("/testdb/test.jpg?size=oriented", nil)
+			Expect(rec.Code).To(Equal(http.StatusOK))
+			Expect(detector.options.Faces.Detected).To(BeNil())
+			Expect(atomic.LoadInt32(&detector.detections)).To(BeZero())
+		})
+	})
+
+	It("will look for images in the bucket of the request", func() {
+		storage.AddImageFromFile("testdb/avatars", "avatar.jpg", "./testdata/image.jpg", nil)
+		serve("/testdb/avatars/avatar.jpg?size=45x35", nil)
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(storage.Images("testdb/avatars")).To(HaveLen(2))
+
+		serve("/testdb/avatar.jpg", nil)
+		Expect(rec.Code).To(Equal(http.StatusNotFound))
+	})
+
+	It("will have original metadata entries after resize", func() {
+		serve("/testdb/test.jpg?size=50x40", nil)
+		Expect(rec.Code).To(Equal(http.StatusOK))
+
+		child, err := storage.FindImageByParentFilename("testdb", "test.jpg", &Entry{Width: 50, Height: 40, Type: "crop"})
+		Expect(err).ToNot(HaveOccurred())
+		meta := child.(MetaContainer).Meta()
+		Expect(meta).To(HaveKeyWithValue("copyright", "ACME Fantasia"))
+		Expect(meta).To(HaveKeyWithValue("originalFilename", "test.jpg"))
+		Expect(meta).To(HaveKeyWithValue("size", "50x40"))
+		Expect(meta).To(HaveKeyWithValue("width", 50))
+		Expect(meta).To(HaveKeyWithValue("height", 40))
+	})
+})
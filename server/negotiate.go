@@ -0,0 +1,69 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/VoycerAG/gridfs-image-server/server/paint"
+)
+
+//negotiatedFormats will be served to clients that accept them, ordered by preference.
+//avif is not supported, because there is no encoder available
+var negotiatedFormats = []string{"webp"}
+
+//negotiateFormat returns a copy of entry that uses a format the client explicitly accepts.
+//Entries with a fixed format will not be changed
+func negotiateFormat(r *http.Request, entry *Entry) *Entry {
+	if entry.Format != "" && entry.Format != paint.FormatAuto {
+		return entry
+	}
+
+	accept := strings.Join(r.Header["Accept"], ",")
+	for _, format := range negotiatedFormats {
+		if paint.CanEncode(format) && accepts(accept, "image/"+format) {
+			negotiated := *entry
+			negotiated.Format = format
+			negotiated.negotiated = true
+			return &negotiated
+		}
+	}
+
+	return entry
+}
+
+//outputFormat returns the format the resized image of entry will be encoded to.
+//Animations keep their format if it has been negotiated, because they would lose their frames
+func outputFormat(entry *Entry, controller paint.Controller) string {
+	if entry.negotiated && controller.Animated() {
+		return controller.Format()
+	}
+
+	return paint.OutputFormat(entry.Format, controller.Format(), controller.Image())
+}
+
+//accepts returns true if the accept header contains mediaType with a quality above zero
+//wildcards are ignored, because most clients send them without supporting every format
+func accepts(accept, mediaType string) bool {
+	for _, mediaRange := range strings.Split(accept, ",") {
+		params := strings.Split(mediaRange, ";")
+		if !strings.EqualFold(strings.TrimSpace(params[0]), mediaType) {
+			continue
+		}
+
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+
+			if quality, err := strconv.ParseFloat(param[2:], 64); err == nil && quality <= 0 {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,621 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	//amzMetaPrefix is the header prefix of s3 user-metadata
+	amzMetaPrefix = "X-Amz-Meta-"
+	//amzMetaKeys is the user-metadata header that contains the metadata keys with their original case,
+	//because s3 returns all keys in lower case
+	amzMetaKeys = amzMetaPrefix + "Image-Server-Keys"
+	//amzDateFormat is the timestamp format used for signing requests
+	amzDateFormat = "20060102T150405Z"
+	//defaultChildPrefix is the key prefix for resized images
+	defaultChildPrefix = "_resized/"
+)
+
+//ObjectStorage stores images in an s3 compatible object storage.
+//Every database is a bucket, originals are looked up by their key.
+//If the namespace contains a bucket, e.g. "database/avatars", it is used as key prefix "avatars/".
+//Resized images are stored beneath ChildPrefix + originalKey + "/" in the same bucket,
+//their metadata is stored as object user-metadata.
+//Buckets are addressed in path style, so it works with most s3 compatible services.
+type ObjectStorage struct {
+	Endpoint    string
+	Region      string
+	AccessKey   string
+	SecretKey   string
+	ChildPrefix string
+	Client      *http.Client
+}
+
+//NewObjectStorage returns a new object storage provider for the given endpoint, e.g. https://s3.eu-central-1.amazonaws.com
+func NewObjectStorage(endpoint, region, accessKey, secretKey string) (Storage, error) {
+	if endpoint == "" {
+		return nil, errors.New("endpoint must be set")
+	}
+
+	if _, err := url.Parse(endpoint); err != nil {
+		return nil, err
+	}
+
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	return &ObjectStorage{
+		Endpoint:    strings.TrimRight(endpoint, "/"),
+		Region:      region,
+		AccessKey:   accessKey,
+		SecretKey:   secretKey,
+		ChildPrefix: defaultChildPrefix,
+		Client:      http.DefaultClient,
+	}, nil
+}
+
+type objectCacheable struct {
+	storage      *ObjectStorage
+	bucket       string
+	key          string
+	etag         string
+	size         int64
+	lastModified time.Time
+	meta         map[string]interface{}
+	data         []byte
+}
+
+func (oc objectCacheable) LastModified() time.Time {
+	return oc.lastModified
+}
+
+func (oc objectCacheable) CacheIdentifier() string {
+	return oc.etag
+}
+
+//Name returns the last element of the object key
+func (oc objectCacheable) Name() string {
+	return oc.key[strings.LastIndex(oc.key, "/")+1:]
+}
+
+//Data will only download the object when it is read
+func (oc objectCacheable) Data() ReadSeekCloser {
+	if oc.data != nil {
+		return memoryReader{bytes.NewReader(oc.data)}
+	}
+
+	return &objectReader{object: oc}
+}
+
+func (oc objectCacheable) Meta() map[string]interface{} {
+	return oc.meta
+}
+
+//implement `Identity` interface
+func (oc objectCacheable) ID() interface{} {
+	return oc.key
+}
+
+//objectReader downloads the object on the first read
+//seeking is possible without downloading because the size is already known
+type objectReader struct {
+	object objectCacheable
+	reader *bytes.Reader
+	offset int64
+}
+
+func (o *objectReader) Read(p []byte) (int, error) {
+	if err := o.load(); err != nil {
+		return 0, err
+	}
+
+	return o.reader.Read(p)
+}
+
+func (o *objectReader) Seek(offset int64, whence int) (int64, error) {
+	if o.reader != nil || o.object.size < 0 {
+		if err := o.load(); err != nil {
+			return 0, err
+		}
+
+		return o.reader.Seek(offset, whence)
+	}
+
+	switch whence {
+	case os.SEEK_SET:
+	case os.SEEK_CUR:
+		offset += o.offset
+	case os.SEEK_END:
+		offset += o.object.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	o.offset = offset
+	return offset, nil
+}
+
+func (o *objectReader) load() error {
+	if o.reader != nil {
+		return nil
+	}
+
+	data, err := o.object.storage.download(o.object.bucket, o.object.key)
+	if err != nil {
+		return err
+	}
+
+	o.reader = bytes.NewReader(data)
+	_, err = o.reader.Seek(o.offset, os.SEEK_SET)
+	return err
+}
+
+func (o *objectReader) Close() error {
+	return nil
+}
+
+//IsValidID will always return false, objects can only be found by their key
+func (o ObjectStorage) IsValidID(id string) bool {
+	return false
+}
+
+//FindImageByParentID behaves like FindImageByParentFilename, because the id of an object is its key
+func (o ObjectStorage) FindImageByParentID(namespace, id string, entry *Entry) (Cacheable, error) {
+	return o.FindImageByParentFilename(namespace, id, entry)
+}
+
+//FindImageByParentFilename returns either the resized image that actually exists, or the original if entry is nil
+func (o ObjectStorage) FindImageByParentFilename(namespace, filename string, entry *Entry) (Cacheable, error) {
+	bucket, keyPrefix := splitObjectNamespace(namespace)
+	key := keyPrefix + filename
+	if entry != nil {
+		key = o.childKey(key, entry)
+	}
+
+	resp, err := o.do("HEAD", bucket, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("no image found for filename %s", filename)
+	}
+
+	lastModified, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		lastModified = time.Now()
+	}
+
+	return &objectCacheable{
+		storage:      &o,
+		bucket:       bucket,
+		key:          key,
+		etag:         strings.Trim(resp.Header.Get("Etag"), `"`),
+		size:         resp.ContentLength,
+		lastModified: lastModified,
+		meta:         decodeUserMetadata(resp.Header),
+	}, nil
+}
+
+//StoreImage will create or replace an original object
+func (o ObjectStorage) StoreImage(
+	namespace,
+	filename,
+	contentType string,
+	reader io.Reader,
+	metadata map[string]interface{},
+) (Cacheable, error) {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	bucket, keyPrefix := splitObjectNamespace(namespace)
+	header := encodeUserMetadata(metadata)
+	header.Set("Content-Type", contentType)
+
+	return o.put(bucket, keyPrefix+filename, data, header, metadata)
+}
+
+//StoreChildImage will create a new object from source
+func (o ObjectStorage) StoreChildImage(
+	database,
+	imageFormat string,
+	reader io.Reader,
+	imageWidth,
+	imageHeight int,
+	original Cacheable,
+	entry *Entry,
+) (Cacheable, error) {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	bucket, keyPrefix := splitObjectNamespace(database)
+	metadata := childMetadata(imageWidth, imageHeight, original, entry)
+	key := o.childKey(keyPrefix+original.Name(), entry)
+	if identifier, ok := original.(Identity); ok {
+		if originalKey, ok := identifier.ID().(string); ok {
+			key = o.childKey(originalKey, entry)
+		}
+	}
+
+	header := encodeUserMetadata(metadata)
+	header.Set("Content-Type", "image/"+imageFormat)
+
+	child, err := o.put(bucket, key, data, header, metadata)
+	if err != nil {
+		log.Printf("Error for filename %s with size %dx%d\n", original.Name(), entry.Width, entry.Height)
+		return nil, err
+	}
+
+	return child, nil
+}
+
+//DeleteImage removes the original object with the given key and all of its resized images
+func (o ObjectStorage) DeleteImage(namespace, filename string) (int, error) {
+	bucket, keyPrefix := splitObjectNamespace(namespace)
+	key := keyPrefix + filename
+
+	resp, err := o.do("HEAD", bucket, key, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return 0, nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("could not find %s, status %d", key, resp.StatusCode)
+	}
+
+	children, err := o.list(bucket, o.ChildPrefix+key+"/")
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, child := range append(children, key) {
+		if err := o.remove(bucket, child); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+
+	return removed, nil
+}
+
+//remove deletes the object bucket/key
+func (o ObjectStorage) remove(bucket, key string) error {
+	resp, err := o.do("DELETE", bucket, key, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("could not delete %s, status %d", key, resp.StatusCode)
+	}
+
+	return nil
+}
+
+//listBucketResult is the response of ListObjectsV2
+type listBucketResult struct {
+	Contents []struct {
+		Key string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+//list returns the keys of all objects in bucket that start with prefix
+func (o ObjectStorage) list(bucket, prefix string) ([]string, error) {
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	keys := []string{}
+
+	for {
+		resp, err := o.send("GET", "/"+uriEncode(bucket, true), query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		result := listBucketResult{}
+		if resp.StatusCode == http.StatusOK {
+			err = xml.NewDecoder(resp.Body).Decode(&result)
+		} else {
+			err = fmt.Errorf("could not list %s, status %d", prefix, resp.StatusCode)
+		}
+		resp.Body.Close()
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, object := range result.Contents {
+			keys = append(keys, object.Key)
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return keys, nil
+		}
+
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+//put uploads data as object bucket/key
+func (o ObjectStorage) put(bucket, key string, data []byte, header http.Header, metadata map[string]interface{}) (Cacheable, error) {
+	resp, err := o.do("PUT", bucket, key, data, header)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("could not store %s, status %d: %s", key, resp.StatusCode, message)
+	}
+
+	if metadata == nil {
+		metadata = map[string]interface{}{}
+	}
+
+	return &objectCacheable{
+		storage:      &o,
+		bucket:       bucket,
+		key:          key,
+		etag:         strings.Trim(resp.Header.Get("Etag"), `"`),
+		size:         int64(len(data)),
+		lastModified: time.Now(),
+		meta:         metadata,
+		data:         data,
+	}, nil
+}
+
+//childKey returns the deterministic key of a resized image
+func (o ObjectStorage) childKey(originalKey string, entry *Entry) string {
+	return o.ChildPrefix + originalKey + "/" + entry.childKey()
+}
+
+//splitObjectNamespace returns the bucket and the key prefix of the namespace
+func splitObjectNamespace(namespace string) (string, string) {
+	if i := strings.Index(namespace, "/"); i >= 0 {
+		return namespace[:i], namespace[i+1:] + "/"
+	}
+
+	return namespace, ""
+}
+
+func (o ObjectStorage) download(bucket, key string) ([]byte, error) {
+	resp, err := o.do("GET", bucket, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not download %s, status %d", key, resp.StatusCode)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+//do sends a signed request for the object at bucket/key
+func (o ObjectStorage) do(method, bucket, key string, body []byte, header http.Header) (*http.Response, error) {
+	if bucket == "" || key == "" {
+		return nil, errors.New("bucket and key must not be empty")
+	}
+
+	return o.send(method, "/"+uriEncode(bucket, true)+"/"+uriEncode(key, false), nil, body, header)
+}
+
+//send sends a signed request for the already encoded path with optional query parameters
+func (o ObjectStorage) send(method, path string, query url.Values, body []byte, header http.Header) (*http.Response, error) {
+	target := o.Endpoint + path
+	if len(query) > 0 {
+		target += "?" + canonicalQueryString(query)
+	}
+
+	req, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.ContentLength = int64(len(body))
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	o.sign(req, body, time.Now().UTC())
+
+	client := o.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return client.Do(req)
+}
+
+//sign adds an AWS signature version 4 to the request
+func (o ObjectStorage) sign(req *http.Request, body []byte, now time.Time) {
+	payloadHash := sha256.Sum256(body)
+	amzDate := now.Format(amzDateFormat)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders bytes.Buffer
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQueryString(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	date := now.Format("20060102")
+	scope := date + "/" + o.Region + "/s3/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+o.SecretKey), date)
+	key = hmacSHA256(key, o.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		o.AccessKey, scope, signedHeaders, signature,
+	))
+}
+
+//canonicalQueryString returns the query parameters sorted by name and encoded like described in RFC 3986
+func canonicalQueryString(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parameters := []string{}
+	for _, name := range names {
+		values := append([]string{}, query[name]...)
+		sort.Strings(values)
+		for _, value := range values {
+			parameters = append(parameters, uriEncode(name, true)+"="+uriEncode(value, true))
+		}
+	}
+
+	return strings.Join(parameters, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+//uriEncode encodes everything but unreserved characters like described in RFC 3986
+func uriEncode(value string, encodeSlash bool) string {
+	var result bytes.Buffer
+	for _, b := range []byte(value) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9', b == '-', b == '_', b == '.', b == '~':
+			result.WriteByte(b)
+		case b == '/' && !encodeSlash:
+			result.WriteByte(b)
+		default:
+			fmt.Fprintf(&result, "%%%02X", b)
+		}
+	}
+
+	return result.String()
+}
+
+//encodeUserMetadata converts metadata into s3 user-metadata headers,
+//non ascii values will be encoded according to RFC 2047.
+//Keys that are not in lower case are listed in an additional header, so their case can be restored
+func encodeUserMetadata(metadata map[string]interface{}) http.Header {
+	header := http.Header{}
+	keys := []string{}
+	for k, v := range metadata {
+		header.Set(amzMetaPrefix+k, mime.QEncoding.Encode("utf-8", fmt.Sprint(v)))
+		if k != strings.ToLower(k) {
+			keys = append(keys, k)
+		}
+	}
+
+	if len(keys) > 0 {
+		sort.Strings(keys)
+		header.Set(amzMetaKeys, mime.QEncoding.Encode("utf-8", strings.Join(keys, ",")))
+	}
+
+	return header
+}
+
+//decodeUserMetadata returns all s3 user-metadata of the response headers
+//numeric values will be converted back to integers. Keys are returned in their original case
+//if it has been stored, all other keys are in lower case
+func decodeUserMetadata(header http.Header) map[string]interface{} {
+	decoder := mime.WordDecoder{}
+	decode := func(k string) string {
+		value, err := decoder.DecodeHeader(header.Get(k))
+		if err != nil {
+			return header.Get(k)
+		}
+
+		return value
+	}
+
+	names := map[string]string{}
+	if keys := decode(amzMetaKeys); keys != "" {
+		for _, key := range strings.Split(keys, ",") {
+			names[strings.ToLower(key)] = key
+		}
+	}
+
+	metadata := map[string]interface{}{}
+	for k := range header {
+		if !strings.HasPrefix(k, amzMetaPrefix) || k == amzMetaKeys {
+			continue
+		}
+
+		value := decode(k)
+		name := strings.ToLower(k[len(amzMetaPrefix):])
+		if original, found := names[name]; found {
+			name = original
+		}
+
+		if number, err := strconv.Atoi(value); err == nil {
+			metadata[name] = number
+		} else {
+			metadata[name] = value
+		}
+	}
+
+	return metadata
+}
@@ -0,0 +1,191 @@
+package paint
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+
+	"github.com/disintegration/imaging"
+)
+
+//animation contains all frames of an animated gif
+//every frame is composed onto the full canvas, so frames can be resized independently
+type animation struct {
+	frames    []image.Image
+	palettes  []color.Palette
+	delay     []int
+	loopCount int
+}
+
+//newAnimation composes the frames of an animated gif onto a canvas with the given bounds
+//the disposal of every frame is applied before the next frame will be drawn
+func newAnimation(source *gif.GIF, bounds image.Rectangle) *animation {
+	result := &animation{
+		frames:    make([]image.Image, len(source.Image)),
+		palettes:  make([]color.Palette, len(source.Image)),
+		delay:     source.Delay,
+		loopCount: source.LoopCount,
+	}
+
+	canvas := image.NewRGBA(bounds)
+	for i, frame := range source.Image {
+		disposal := byte(0)
+		if i < len(source.Disposal) {
+			disposal = source.Disposal[i]
+		}
+
+		var previous *image.RGBA
+		if disposal == gif.DisposalPrevious {
+			previous = cloneRGBA(canvas)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		result.frames[i] = cloneRGBA(canvas)
+		result.palettes[i] = frame.Palette
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.ZP, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+
+	return result
+}
+
+//windowResizer is implemented by resizers that crop to a window depending on the content of the image
+type windowResizer interface {
+	window(input image.Image, dstWidth, dstHeight int) image.Rectangle
+}
+
+//resize applies the resizer to every frame. The window of resizers that depend on the content
+//is chosen by the first frame and kept for all frames, otherwise the animation would jitter
+func (a *animation) resize(resizer Resizer, width, height int, options ResizeOptions) error {
+	if windowed, ok := resizer.(windowResizer); ok && width >= 0 && height >= 0 {
+		window := windowed.window(a.frames[0], width, height)
+		for i, frame := range a.frames {
+			a.frames[i] = imaging.Resize(imaging.Crop(frame, window), width, height, imaging.Lanczos)
+		}
+
+		return nil
+	}
+
+	for i, frame := range a.frames {
+		resized, err := ResizeWithOptions(resizer, frame, width, height, options)
+		if err != nil {
+			return err
+		}
+
+		a.frames[i] = resized
+	}
+
+	return nil
+}
+
+//gif returns the animation with paletted frames, as every frame covers the
+//whole canvas, each frame is disposed before the next one will be drawn
+func (a *animation) gif() *gif.GIF {
+	result := &gif.GIF{
+		Image:     make([]*image.Paletted, len(a.frames)),
+		Delay:     a.delay,
+		Disposal:  make([]byte, len(a.frames)),
+		LoopCount: a.loopCount,
+	}
+
+	for i, frame := range a.frames {
+		bounds := frame.Bounds()
+		paletted := image.NewPaletted(image.Rect(0, 0, bounds.Dx(), bounds.Dy()), framePalette(a.palettes[i], frame))
+		draw.Draw(paletted, paletted.Bounds(), frame, bounds.Min, draw.Src)
+
+		result.Image[i] = paletted
+		result.Disposal[i] = gif.DisposalBackground
+	}
+
+	return result
+}
+
+//framePalette returns the palette of the original frame,
+//a transparent color is added if the frame is not opaque
+func framePalette(original color.Palette, frame image.Image) color.Palette {
+	palette := make(color.Palette, len(original), len(original)+1)
+	copy(palette, original)
+
+	if opaque, ok := frame.(interface {
+		Opaque() bool
+	}); ok && opaque.Opaque() {
+		return palette
+	}
+
+	for _, c := range palette {
+		if _, _, _, alpha := c.RGBA(); alpha == 0 {
+			return palette
+		}
+	}
+
+	if len(palette) < 256 {
+		return append(palette, color.Transparent)
+	}
+
+	palette[len(palette)-1] = color.Transparent
+	return palette
+}
+
+func cloneRGBA(source *image.RGBA) *image.RGBA {
+	result := image.NewRGBA(source.Bounds())
+	copy(result.Pix, source.Pix)
+	return result
+}
+
+//countGIFFrames returns the number of frames of a gif by skipping its blocks,
+//the frames are not decompressed
+func countGIFFrames(data []byte) int {
+	// header and logical screen descriptor
+	if len(data) < 13 {
+		return 0
+	}
+
+	frames := 0
+	position := 13 + colorTableSize(data[10])
+	for position < len(data) {
+		switch data[position] {
+		case 0x21: // extension introducer and label
+			position = skipSubBlocks(data, position+2)
+		case 0x2C: // image descriptor
+			if position+10 > len(data) {
+				return frames
+			}
+
+			// the lzw minimum code size precedes the image data
+			position = skipSubBlocks(data, position+10+colorTableSize(data[position+9])+1)
+			frames++
+		default: // trailer
+			return frames
+		}
+	}
+
+	return frames
+}
+
+//colorTableSize returns the size in bytes of the color table that is announced by flags
+func colorTableSize(flags byte) int {
+	if flags&0x80 == 0 {
+		return 0
+	}
+
+	return 3 << (uint(flags&0x07) + 1)
+}
+
+//skipSubBlocks returns the position after the sub-blocks that start at position
+func skipSubBlocks(data []byte, position int) int {
+	for position < len(data) {
+		size := int(data[position])
+		position += size + 1
+		if size == 0 {
+			break
+		}
+	}
+
+	return position
+}
@@ -1,38 +1,176 @@
 package paint
 
 import (
+	"bytes"
 	"fmt"
 	"image"
+	"image/color/palette"
+	"image/draw"
 	"image/gif"
 	"image/jpeg"
 	"image/png"
 	"io"
+	"io/ioutil"
+
+	// webp originals can be decoded without cgo
+	_ "golang.org/x/image/webp"
 )
 
 //Controller lets you completely control
 //one image
 type Controller interface {
 	Encode(target io.Writer) error
+	EncodeWithOptions(target io.Writer, options EncodeOptions) error
 	Resize(resizeType ResizeType, width, height int) error
+	ResizeWithOptions(resizeType ResizeType, width, height int, options ResizeOptions) error
+	Flatten()
+	AutoOrient()
 	Image() image.Image
 	Format() string
+	Animated() bool
+}
+
+//Limits restrict the dimensions of images that will be decoded
+//zero values are not limited. Animations whose frames exceed MaxPixels together are flattened to their first frame
+type Limits struct {
+	MaxPixels int64 `json:"maxPixels"`
+	MaxWidth  int   `json:"maxWidth"`
+	MaxHeight int   `json:"maxHeight"`
+}
+
+//ImageTooLargeError will be returned if the dimensions of an image exceed the limits
+type ImageTooLargeError struct {
+	Width  int
+	Height int
+	Limits Limits
+}
+
+func (e ImageTooLargeError) Error() string {
+	return fmt.Sprintf("image with %dx%d pixels exceeds the limits", e.Width, e.Height)
+}
+
+//exceeds returns true if an image with the given dimensions must not be decoded
+func (l Limits) exceeds(width, height int) bool {
+	return (l.MaxPixels > 0 && int64(width)*int64(height) > l.MaxPixels) ||
+		(l.MaxWidth > 0 && width > l.MaxWidth) ||
+		(l.MaxHeight > 0 && height > l.MaxHeight)
+}
+
+//exceedsFrames returns true if all frames of an animation with the given dimensions
+//must not be decoded together
+func (l Limits) exceedsFrames(width, height, frames int) bool {
+	return l.MaxPixels > 0 && int64(frames)*int64(width)*int64(height) > l.MaxPixels
 }
 
 //NewController returns a new instance of a basic controller
 func NewController(data io.Reader, customResizers map[ResizeType]Resizer) (Controller, error) {
-	rawData, format, err := image.Decode(data)
+	return NewControllerWithLimits(data, customResizers, Limits{})
+}
+
+//NewControllerWithLimits returns a new instance of a basic controller
+//the dimensions of the image are checked before it will be decoded,
+//an ImageTooLargeError is returned if they exceed the limits.
+//All frames of animated gifs are decoded lazily, animations that exceed MaxPixels
+//with all of their frames only keep their first frame
+func NewControllerWithLimits(data io.Reader, customResizers map[ResizeType]Resizer, limits Limits) (Controller, error) {
+	// the header is kept, so the image can be decoded afterwards without seeking
+	var header bytes.Buffer
+	config, format, err := image.DecodeConfig(io.TeeReader(data, &header))
+	if err != nil {
+		return nil, err
+	}
+
+	if limits.exceeds(config.Width, config.Height) {
+		return nil, ImageTooLargeError{Width: config.Width, Height: config.Height, Limits: limits}
+	}
+
+	if format == "gif" {
+		return newGifController(io.MultiReader(&header, data), config, customResizers, limits)
+	}
+
+	// the metadata segments of jpeg images are located before the frame header, so they have already been read
+	var meta metadata
+	switch format {
+	case "jpeg":
+		meta = readJPEGMetadata(header.Bytes())
+	case "png":
+		meta = readPNGMetadata(&header, data)
+	}
+
+	rawData, format, err := image.Decode(io.MultiReader(&header, data))
 
 	if err != nil {
 		return nil, err
 	}
 
-	return &basicController{data: rawData, imageFormat: format, customResizers: customResizers}, nil
+	return &basicController{
+		data:           rawData,
+		imageFormat:    format,
+		customResizers: customResizers,
+		orientation:    exifOrientation(meta.exif),
+		metadata:       meta,
+	}, nil
+}
+
+//newGifController only decodes the first frame of a gif,
+//the other frames of animations will be decoded once they are resized or encoded.
+//Animations that are too large to decode all frames are flattened
+func newGifController(data io.Reader, config image.Config, customResizers map[ResizeType]Resizer, limits Limits) (Controller, error) {
+	raw, err := ioutil.ReadAll(data)
+	if err != nil {
+		return nil, err
+	}
+
+	first, err := gif.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+
+	frames := countGIFFrames(raw)
+	if frames <= 1 {
+		return &basicController{data: first, imageFormat: "gif", customResizers: customResizers}, nil
+	}
+
+	canvas := image.NewRGBA(image.Rect(0, 0, config.Width, config.Height))
+	draw.Draw(canvas, first.Bounds(), first, first.Bounds().Min, draw.Over)
+	if limits.exceedsFrames(config.Width, config.Height, frames) {
+		return &basicController{data: canvas, imageFormat: "gif", customResizers: customResizers}, nil
+	}
+
+	return &basicController{
+		data:           canvas,
+		imageFormat:    "gif",
+		customResizers: customResizers,
+		animationData:  raw,
+	}, nil
 }
 
 type basicController struct {
 	data           image.Image
 	imageFormat    string
 	customResizers map[ResizeType]Resizer
+	animation      *animation
+	animationData  []byte
+	orientation    int
+	metadata       metadata
+}
+
+//decodeAnimation decodes all frames of an animated gif that has not been flattened
+func (b *basicController) decodeAnimation() error {
+	if b.animationData == nil {
+		return nil
+	}
+
+	bounds := b.data.Bounds()
+	decoded, err := gif.DecodeAll(bytes.NewReader(b.animationData))
+	if err != nil {
+		return err
+	}
+
+	b.animation = newAnimation(decoded, bounds)
+	b.animationData = nil
+	b.data = b.animation.frames[0]
+	return nil
 }
 
 func (b basicController) Format() string {
@@ -43,9 +181,32 @@ func (b basicController) Image() image.Image {
 	return b.data
 }
 
+//Animated returns true if the image has more than one frame that will be encoded
+func (b basicController) Animated() bool {
+	return b.animation != nil || b.animationData != nil
+}
+
 func (b *basicController) Resize(resizeType ResizeType, width, height int) error {
+	return b.ResizeWithOptions(resizeType, width, height, ResizeOptions{})
+}
+
+//ResizeWithOptions passes the options to resizers that implement OptionsResizer
+func (b *basicController) ResizeWithOptions(resizeType ResizeType, width, height int, options ResizeOptions) error {
+	if err := b.decodeAnimation(); err != nil {
+		return err
+	}
+
 	resizer := newResizerByType(resizeType, b.customResizers)
-	data, err := resizer.Resize(b.data, width, height)
+	if b.animation != nil {
+		if err := b.animation.resize(resizer, width, height, options); err != nil {
+			return err
+		}
+
+		b.data = b.animation.frames[0]
+		return nil
+	}
+
+	data, err := ResizeWithOptions(resizer, b.data, width, height, options)
 	if err != nil {
 		return err
 	}
@@ -53,18 +214,163 @@ func (b *basicController) Resize(resizeType ResizeType, width, height int) error
 	return nil
 }
 
+//Flatten drops all frames of an animation except the first one
+func (b *basicController) Flatten() {
+	b.animation = nil
+	b.animationData = nil
+}
+
+//AutoOrient rotates and flips jpeg images according to their exif orientation,
+//it must be called before resizing
+func (b *basicController) AutoOrient() {
+	b.data = orient(b.data, b.orientation)
+	b.orientation = 1
+}
+
+//PNGCompression defines how much effort is spent compressing png images
+type PNGCompression string
+
+const (
+	//PNGCompressionDefault uses the default compression level of the png encoder
+	PNGCompressionDefault PNGCompression = "default"
+	//PNGCompressionNone does not compress at all
+	PNGCompressionNone PNGCompression = "none"
+	//PNGCompressionFast compresses fast, but creates larger images
+	PNGCompressionFast PNGCompression = "fast"
+	//PNGCompressionBest creates the smallest images and is used if nothing else is specified
+	PNGCompressionBest PNGCompression = "best"
+)
+
+//pngCompressionLevels maps the compression to the levels of the png encoder
+var pngCompressionLevels = map[PNGCompression]png.CompressionLevel{
+	"":                    png.BestCompression,
+	PNGCompressionDefault: png.DefaultCompression,
+	PNGCompressionNone:    png.NoCompression,
+	PNGCompressionFast:    png.BestSpeed,
+	PNGCompressionBest:    png.BestCompression,
+}
+
+//IsValidPNGCompression returns true if compression is known, an empty compression is valid as well
+func IsValidPNGCompression(compression PNGCompression) bool {
+	_, found := pngCompressionLevels[compression]
+	return found
+}
+
+//EncodeOptions control the encoding of an image
+//Format is the output format, the format of the original will be used if it is empty. See OutputFormat.
+//Quality is used for jpeg and lossy webp images, 0 uses the default quality.
+//Lossless is only supported by webp.
+//Progressive is currently ignored, because the jpeg encoder can only write baseline images.
+//Metadata of jpeg and png originals is only kept in jpeg and png images.
+type EncodeOptions struct {
+	Format         string
+	Quality        int
+	Lossless       bool
+	Progressive    bool
+	PNGCompression PNGCompression
+	Metadata       MetadataPolicy
+}
+
+//FormatAuto selects the output format depending on the image,
+//png is used for images with transparency, jpeg for all others
+const FormatAuto = "auto"
+
+//outputFormats contains all formats images can be encoded to
+var outputFormats = map[string]bool{
+	"jpeg": true,
+	"png":  true,
+	"gif":  true,
+	"webp": true,
+}
+
+//CanEncode returns true if images can be encoded to format
+//webp encoding is only available if the server is built with cgo and the build tag webp
+func CanEncode(format string) bool {
+	if format == "webp" {
+		return webpEncoding
+	}
+
+	return outputFormats[format]
+}
+
+//OutputFormat returns the format an image will be encoded to,
+//if requested is empty, the format of the original will be used
+func OutputFormat(requested, original string, img image.Image) string {
+	switch requested {
+	case "":
+		return original
+	case FormatAuto:
+		if opaque, ok := img.(interface {
+			Opaque() bool
+		}); ok && opaque.Opaque() {
+			return "jpeg"
+		}
+
+		return "png"
+	default:
+		return requested
+	}
+}
+
 func (b basicController) Encode(target io.Writer) error {
-	switch b.imageFormat {
+	return b.EncodeWithOptions(target, EncodeOptions{})
+}
+
+func (b basicController) EncodeWithOptions(target io.Writer, options EncodeOptions) error {
+	options.Format = OutputFormat(options.Format, b.imageFormat, b.data)
+
+	if options.Quality <= 0 || options.Quality > 100 {
+		options.Quality = jpeg.DefaultQuality
+	}
+
+	if !IsValidMetadataPolicy(options.Metadata) {
+		return fmt.Errorf("invalid metadata policy %s", options.Metadata)
+	}
+
+	switch options.Format {
 	case "jpeg":
-		jpeg.Encode(target, b.data, &jpeg.Options{jpeg.DefaultQuality})
+		return encodeJPEG(target, b.data, options.Quality, b.metadata.filter(options.Metadata))
 	case "png":
-		encoder := png.Encoder{CompressionLevel: png.BestCompression}
-		encoder.Encode(target, b.data)
+		level, found := pngCompressionLevels[options.PNGCompression]
+		if !found {
+			return fmt.Errorf("invalid png compression %s", options.PNGCompression)
+		}
+
+		encoder := png.Encoder{CompressionLevel: level}
+		return encodePNG(target, encoder, b.data, b.metadata.filter(options.Metadata))
 	case "gif":
-		gif.Encode(target, b.data, &gif.Options{256, nil, nil})
+		if err := b.decodeAnimation(); err != nil {
+			return err
+		}
+
+		if b.animation != nil {
+			return gif.EncodeAll(target, b.animation.gif())
+		}
+
+		return encodeGIF(target, b.data)
+	case "webp":
+		return encodeWebp(target, b.data, options)
 	default:
 		return fmt.Errorf("invalid imageFormat given")
 	}
+}
+
+//encodeGIF encodes a still image, a transparent color is reserved in the palette
+//if the image is not opaque, e.g. the remainder of padded images
+func encodeGIF(target io.Writer, img image.Image) error {
+	if _, ok := img.(*image.Paletted); ok {
+		return gif.Encode(target, img, &gif.Options{256, nil, nil})
+	}
 
-	return nil
+	if opaque, ok := img.(interface {
+		Opaque() bool
+	}); !ok || opaque.Opaque() {
+		return gif.Encode(target, img, &gif.Options{256, nil, nil})
+	}
+
+	bounds := img.Bounds()
+	paletted := image.NewPaletted(bounds, framePalette(palette.Plan9[:255], img))
+	draw.FloydSteinberg.Draw(paletted, bounds, img, bounds.Min)
+
+	return gif.Encode(target, paletted, nil)
 }
@@ -3,14 +3,18 @@ package paint_test
 import (
 	"bufio"
 	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
 	"image"
+	"image/color"
+	"image/draw"
 	"io"
 	"os"
 
 	// png file formats
+	"image/gif"
 	_ "image/png"
-	// gif file formats
-	_ "image/gif"
 	// jpeg file formats
 	_ "image/jpeg"
 
@@ -153,6 +157,342 @@ var _ = Describe("Controller to resize all types of images", func() {
 		})
 	})
 
+	Context("Encoding", func() {
+		It("should decode webp originals", func() {
+			testFile, err := os.Open("../testdata/image.webp")
+			Expect(err).ToNot(HaveOccurred())
+			defer testFile.Close()
+			controller, err := NewController(testFile, map[ResizeType]Resizer{})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(controller.Format()).To(Equal("webp"))
+			Expect(controller.Resize(TypeResize, 20, 10)).To(Succeed())
+
+			var buffer bytes.Buffer
+			Expect(controller.EncodeWithOptions(&buffer, EncodeOptions{Format: "png"})).To(Succeed())
+			actual, format, err := image.Decode(&buffer)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(format).To(Equal("png"))
+			Expect(actual.Bounds()).To(Equal(image.Rect(0, 0, 20, 10)))
+		})
+
+		It("should encode jpeg images with the given quality", func() {
+			testFile, err := os.Open("../testdata/image.jpg")
+			Expect(err).ToNot(HaveOccurred())
+			defer testFile.Close()
+			controller, err := NewController(testFile, map[ResizeType]Resizer{})
+			Expect(err).ToNot(HaveOccurred())
+
+			var low, high bytes.Buffer
+			Expect(controller.EncodeWithOptions(&low, EncodeOptions{Quality: 10})).To(Succeed())
+			Expect(controller.EncodeWithOptions(&high, EncodeOptions{Quality: 95})).To(Succeed())
+			Expect(low.Len()).To(BeNumerically("<", high.Len()))
+		})
+
+		It("should compress png images with the given compression", func() {
+			testFile, err := os.Open("../testdata/normal.png")
+			Expect(err).ToNot(HaveOccurred())
+			defer testFile.Close()
+			controller, err := NewController(testFile, map[ResizeType]Resizer{})
+			Expect(err).ToNot(HaveOccurred())
+
+			var none, best bytes.Buffer
+			Expect(controller.EncodeWithOptions(&none, EncodeOptions{PNGCompression: PNGCompressionNone})).To(Succeed())
+			Expect(controller.EncodeWithOptions(&best, EncodeOptions{})).To(Succeed())
+			Expect(best.Len()).To(BeNumerically("<", none.Len()))
+			Expect(controller.EncodeWithOptions(&bytes.Buffer{}, EncodeOptions{PNGCompression: "maximum"})).ToNot(Succeed())
+		})
+
+		It("should select the output format", func() {
+			opaque := image.NewRGBA(image.Rect(0, 0, 2, 2))
+			draw.Draw(opaque, opaque.Bounds(), image.White, image.ZP, draw.Src)
+			transparent := image.NewRGBA(image.Rect(0, 0, 2, 2))
+
+			Expect(OutputFormat("", "gif", opaque)).To(Equal("gif"))
+			Expect(OutputFormat("webp", "gif", opaque)).To(Equal("webp"))
+			Expect(OutputFormat(FormatAuto, "png", opaque)).To(Equal("jpeg"))
+			Expect(OutputFormat(FormatAuto, "jpeg", transparent)).To(Equal("png"))
+		})
+
+		It("should reject unknown formats", func() {
+			testFile, err := os.Open("../testdata/image.jpg")
+			Expect(err).ToNot(HaveOccurred())
+			defer testFile.Close()
+			controller, err := NewController(testFile, map[ResizeType]Resizer{})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(controller.EncodeWithOptions(&bytes.Buffer{}, EncodeOptions{Format: "bmp"})).ToNot(Succeed())
+		})
+	})
+
+	Context("Animations", func() {
+		decodeAnimation := func(controller Controller) *gif.GIF {
+			var buffer bytes.Buffer
+			Expect(controller.Encode(&buffer)).To(Succeed())
+			result, err := gif.DecodeAll(&buffer)
+			Expect(err).ToNot(HaveOccurred())
+			return result
+		}
+
+		It("should resize every frame of animated gifs", func() {
+			testFile, err := os.Open("../testdata/animated.gif")
+			Expect(err).ToNot(HaveOccurred())
+			defer testFile.Close()
+			controller, err := NewController(testFile, map[ResizeType]Resizer{})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(controller.Format()).To(Equal("gif"))
+			Expect(controller.Animated()).To(BeTrue())
+			Expect(controller.Resize(TypeCrop, 50, 40)).To(Succeed())
+			Expect(controller.Image().Bounds()).To(Equal(image.Rect(0, 0, 50, 40)))
+
+			resized := decodeAnimation(controller)
+			Expect(resized.Image).To(HaveLen(12))
+			Expect(resized.LoopCount).To(Equal(0))
+			for i, frame := range resized.Image {
+				Expect(frame.Bounds()).To(Equal(image.Rect(0, 0, 50, 40)))
+				Expect(resized.Delay[i]).To(Equal(13))
+				Expect(resized.Disposal[i]).To(Equal(byte(gif.DisposalBackground)))
+			}
+		})
+
+		It("should only keep the first frame if flattened", func() {
+			testFile, err := os.Open("../testdata/animated.gif")
+			Expect(err).ToNot(HaveOccurred())
+			defer testFile.Close()
+			controller, err := NewController(testFile, map[ResizeType]Resizer{})
+			Expect(err).ToNot(HaveOccurred())
+			controller.Flatten()
+			Expect(controller.Animated()).To(BeFalse())
+			Expect(controller.Resize(TypeCrop, 50, 40)).To(Succeed())
+
+			Expect(decodeAnimation(controller).Image).To(HaveLen(1))
+		})
+
+		It("should flatten animations that exceed the pixel limit with all frames together", func() {
+			openWithLimits := func(limits Limits) Controller {
+				testFile, err := os.Open("../testdata/animated.gif")
+				Expect(err).ToNot(HaveOccurred())
+				defer testFile.Close()
+				controller, err := NewControllerWithLimits(testFile, map[ResizeType]Resizer{}, limits)
+				Expect(err).ToNot(HaveOccurred())
+				return controller
+			}
+
+			bounds := openWithLimits(Limits{}).Image().Bounds()
+			pixels := int64(bounds.Dx() * bounds.Dy())
+
+			animated := openWithLimits(Limits{MaxPixels: pixels * 12})
+			Expect(animated.Animated()).To(BeTrue())
+			Expect(animated.Resize(TypeCrop, 50, 40)).To(Succeed())
+			Expect(decodeAnimation(animated).Image).To(HaveLen(12))
+
+			flattened := openWithLimits(Limits{MaxPixels: pixels * 11})
+			Expect(flattened.Animated()).To(BeFalse())
+			Expect(flattened.Image().Bounds()).To(Equal(bounds))
+			Expect(flattened.Resize(TypeCrop, 50, 40)).To(Succeed())
+			Expect(decodeAnimation(flattened).Image).To(HaveLen(1))
+		})
+	})
+
+	Context("Orientation", func() {
+		openOriented := func(orientation int) Controller {
+			testFile, err := os.Open(fmt.Sprintf("../testdata/orientation_%d.jpg", orientation))
+			Expect(err).ToNot(HaveOccurred())
+			defer testFile.Close()
+			controller, err := NewController(testFile, map[ResizeType]Resizer{})
+			Expect(err).ToNot(HaveOccurred())
+			return controller
+		}
+
+		isColor := func(c color.Color, r, g, b int) bool {
+			actualR, actualG, actualB, _ := c.RGBA()
+			near := func(actual uint32, expected int) bool {
+				difference := int(actual>>8) - expected
+				return difference > -64 && difference < 64
+			}
+
+			return near(actualR, r) && near(actualG, g) && near(actualB, b)
+		}
+
+		It("should rotate and flip images of all exif orientations", func() {
+			for orientation := 1; orientation <= 8; orientation++ {
+				controller := openOriented(orientation)
+				controller.AutoOrient()
+
+				img := controller.Image()
+				Expect(img.Bounds().Dx()).To(Equal(40), "orientation %d", orientation)
+				Expect(img.Bounds().Dy()).To(Equal(20), "orientation %d", orientation)
+				min := img.Bounds().Min
+				Expect(isColor(img.At(min.X+5, min.Y+5), 255, 0, 0)).To(BeTrue(), "orientation %d", orientation)
+				Expect(isColor(img.At(min.X+35, min.Y+5), 0, 255, 0)).To(BeTrue(), "orientation %d", orientation)
+				Expect(isColor(img.At(min.X+5, min.Y+15), 0, 0, 255)).To(BeTrue(), "orientation %d", orientation)
+			}
+		})
+
+		It("should keep the orientation unless requested", func() {
+			controller := openOriented(6)
+			Expect(controller.Image().Bounds().Dx()).To(Equal(20))
+			Expect(controller.Image().Bounds().Dy()).To(Equal(40))
+		})
+	})
+
+	Context("Metadata", func() {
+		encodeWithMetadata := func(path, format string, policy MetadataPolicy) []byte {
+			testFile, err := os.Open(path)
+			Expect(err).ToNot(HaveOccurred())
+			defer testFile.Close()
+			controller, err := NewController(testFile, map[ResizeType]Resizer{})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(controller.Resize(TypeResize, 20, 15)).To(Succeed())
+
+			var buffer bytes.Buffer
+			Expect(controller.EncodeWithOptions(&buffer, EncodeOptions{Format: format, Metadata: policy})).To(Succeed())
+			_, decodedFormat, err := image.Decode(bytes.NewReader(buffer.Bytes()))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(decodedFormat).To(Equal(format))
+			return buffer.Bytes()
+		}
+
+		iccMarker := map[string]string{"jpeg": "ICC_PROFILE", "png": "iCCP"}
+
+		for _, original := range []string{"../testdata/metadata.jpg", "../testdata/metadata.png"} {
+			for _, format := range []string{"jpeg", "png"} {
+				original, format := original, format
+
+				It("should keep the metadata of "+original+" in "+format+" images according to the policy", func() {
+					for _, policy := range []MetadataPolicy{"", MetadataStrip} {
+						stripped := encodeWithMetadata(original, format, policy)
+						Expect(string(stripped)).ToNot(ContainSubstring(iccMarker[format]))
+						Expect(string(stripped)).ToNot(ContainSubstring("Jane Photographer"))
+					}
+
+					icc := encodeWithMetadata(original, format, MetadataICC)
+					Expect(string(icc)).To(ContainSubstring(iccMarker[format]))
+					Expect(string(icc)).ToNot(ContainSubstring("Jane Photographer"))
+
+					copyright := encodeWithMetadata(original, format, MetadataCopyright)
+					Expect(string(copyright)).To(ContainSubstring(iccMarker[format]))
+					Expect(string(copyright)).To(ContainSubstring("(c) 2016 Jane Photographer"))
+					Expect(string(copyright)).ToNot(ContainSubstring("SECRETDATUM"))
+				})
+			}
+		}
+
+		It("should reject unknown metadata policies", func() {
+			testFile, err := os.Open("../testdata/metadata.jpg")
+			Expect(err).ToNot(HaveOccurred())
+			defer testFile.Close()
+			controller, err := NewController(testFile, map[ResizeType]Resizer{})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(controller.EncodeWithOptions(&bytes.Buffer{}, EncodeOptions{Metadata: "all"})).ToNot(Succeed())
+		})
+	})
+
+	Context("Padding", func() {
+		red := color.NRGBA{R: 255, A: 255}
+		blue := color.NRGBA{B: 255, A: 255}
+
+		square := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+		draw.Draw(square, square.Bounds(), image.NewUniform(red), image.ZP, draw.Src)
+
+		It("should fit the image into the box and fill the remainder with the background", func() {
+			padded, err := PadResizer{}.ResizeWithOptions(square, 20, 10, ResizeOptions{Background: blue})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(padded.Bounds()).To(Equal(image.Rect(0, 0, 20, 10)))
+			Expect(padded.At(2, 5)).To(Equal(blue))
+			Expect(padded.At(10, 5)).To(Equal(red))
+			Expect(padded.At(17, 5)).To(Equal(blue))
+		})
+
+		It("should place the image according to the alignment", func() {
+			padded, err := PadResizer{}.ResizeWithOptions(square, 20, 10, ResizeOptions{Background: blue, Alignment: AlignLeft})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(padded.At(2, 5)).To(Equal(red))
+			Expect(padded.At(17, 5)).To(Equal(blue))
+
+			padded, err = PadResizer{}.ResizeWithOptions(square, 10, 20, ResizeOptions{Background: blue, Alignment: AlignBottomRight})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(padded.At(5, 2)).To(Equal(blue))
+			Expect(padded.At(5, 17)).To(Equal(red))
+		})
+
+		It("should be transparent without background", func() {
+			testFile, err := os.Open("../testdata/image.jpg")
+			Expect(err).ToNot(HaveOccurred())
+			defer testFile.Close()
+			controller, err := NewController(testFile, map[ResizeType]Resizer{})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(controller.Resize(TypePad, 100, 100)).To(Succeed())
+			Expect(controller.Image().Bounds()).To(Equal(image.Rect(0, 0, 100, 100)))
+			_, _, _, alpha := controller.Image().At(50, 2).RGBA()
+			Expect(alpha).To(BeZero())
+			Expect(OutputFormat(FormatAuto, controller.Format(), controller.Image())).To(Equal("png"))
+		})
+
+		It("should keep the remainder transparent in gif images", func() {
+			var original bytes.Buffer
+			Expect(gif.Encode(&original, square, nil)).To(Succeed())
+			controller, err := NewController(&original, map[ResizeType]Resizer{})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(controller.Resize(TypePad, 20, 10)).To(Succeed())
+
+			var buffer bytes.Buffer
+			Expect(controller.Encode(&buffer)).To(Succeed())
+			padded, err := gif.Decode(&buffer)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(padded.Bounds()).To(Equal(image.Rect(0, 0, 20, 10)))
+			_, _, _, alpha := padded.At(1, 5).RGBA()
+			Expect(alpha).To(BeZero())
+			Expect(padded.At(10, 5)).To(Equal(color.RGBA{R: 255, A: 255}))
+		})
+
+		It("should parse background colors", func() {
+			parsed, err := ParseColor("#0000ff")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(parsed).To(Equal(blue))
+			parsed, err = ParseColor("ff000080")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(parsed).To(Equal(color.NRGBA{R: 255, A: 128}))
+			Expect(ParseColor("transparent")).To(Equal(color.Transparent))
+			_, err = ParseColor("blue")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("Focal point", func() {
+		red := color.NRGBA{R: 255, A: 255}
+		blue := color.NRGBA{B: 255, A: 255}
+
+		// the left half is red, the right half blue
+		halves := image.NewNRGBA(image.Rect(0, 0, 100, 50))
+		draw.Draw(halves, halves.Bounds(), image.NewUniform(blue), image.ZP, draw.Src)
+		draw.Draw(halves, image.Rect(0, 0, 50, 50), image.NewUniform(red), image.ZP, draw.Src)
+
+		It("should crop around the focal point of the metadata", func() {
+			cropped, err := FocusResizer{}.ResizeWithOptions(halves, 10, 10, ResizeOptions{Meta: map[string]interface{}{"focusX": 0.1, "focusY": 0.5}})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cropped.Bounds()).To(Equal(image.Rect(0, 0, 10, 10)))
+			Expect(cropped.At(9, 5)).To(Equal(red))
+
+			cropped, err = FocusResizer{}.ResizeWithOptions(halves, 10, 10, ResizeOptions{Meta: map[string]interface{}{"focusX": "0.9", "focusY": "0.5"}})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cropped.At(0, 5)).To(Equal(blue))
+		})
+
+		It("should find the focal point in lowercased metadata", func() {
+			cropped, err := FocusResizer{}.ResizeWithOptions(halves, 10, 10, ResizeOptions{Meta: map[string]interface{}{"focusx": "0.9", "focusy": "0.5"}})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cropped.At(0, 5)).To(Equal(blue))
+		})
+
+		It("should crop around the center without a valid focal point", func() {
+			for _, meta := range []map[string]interface{}{nil, {"focusX": 0.1}, {"focusX": 1.5, "focusY": 0.5}} {
+				cropped, err := FocusResizer{}.ResizeWithOptions(halves, 10, 10, ResizeOptions{Meta: meta})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(cropped.At(1, 5)).To(Equal(red))
+				Expect(cropped.At(8, 5)).To(Equal(blue))
+			}
+		})
+	})
+
 	Context("JPG Manipulation", func() {
 		var (
 			testFile io.Reader
@@ -221,4 +561,49 @@ var _ = Describe("Controller to resize all types of images", func() {
 			Expect(expected).To(EqualImage(actual))
 		})
 	})
+
+	Context("Limits", func() {
+		// pngHeader returns a png that declares the given dimensions, but contains no pixel data
+		pngHeader := func(width, height uint32) []byte {
+			ihdr := make([]byte, 17)
+			copy(ihdr, "IHDR")
+			binary.BigEndian.PutUint32(ihdr[4:], width)
+			binary.BigEndian.PutUint32(ihdr[8:], height)
+			ihdr[12] = 8 // bit depth
+			ihdr[13] = 2 // truecolor
+
+			var buffer bytes.Buffer
+			buffer.WriteString("\x89PNG\r\n\x1a\n")
+			binary.Write(&buffer, binary.BigEndian, uint32(13))
+			buffer.Write(ihdr)
+			binary.Write(&buffer, binary.BigEndian, crc32.ChecksumIEEE(ihdr))
+			return buffer.Bytes()
+		}
+
+		It("should reject images with too many pixels before decoding", func() {
+			_, err := NewControllerWithLimits(bytes.NewReader(pngHeader(50000, 50000)), nil, Limits{MaxPixels: 50000000})
+			Expect(err).To(HaveOccurred())
+			tooLarge, ok := err.(ImageTooLargeError)
+			Expect(ok).To(BeTrue())
+			Expect(tooLarge.Width).To(Equal(50000))
+			Expect(tooLarge.Height).To(Equal(50000))
+		})
+
+		It("should reject images exceeding the width or height", func() {
+			_, err := NewControllerWithLimits(bytes.NewReader(pngHeader(2000, 10)), nil, Limits{MaxWidth: 1000})
+			Expect(err).To(BeAssignableToTypeOf(ImageTooLargeError{}))
+			_, err = NewControllerWithLimits(bytes.NewReader(pngHeader(10, 2000)), nil, Limits{MaxHeight: 1000})
+			Expect(err).To(BeAssignableToTypeOf(ImageTooLargeError{}))
+		})
+
+		It("should decode images within the limits", func() {
+			testFile, err := os.Open("../testdata/image.jpg")
+			Expect(err).ToNot(HaveOccurred())
+			defer testFile.Close()
+			controller, err := NewControllerWithLimits(testFile, map[ResizeType]Resizer{}, Limits{MaxPixels: 50000000, MaxWidth: 10000, MaxHeight: 10000})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(controller.Format()).To(Equal("jpeg"))
+			Expect(controller.Image().Bounds().Dx()).To(BeNumerically(">", 0))
+		})
+	})
 })
@@ -0,0 +1,188 @@
+package paint
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+
+	"github.com/disintegration/imaging"
+)
+
+const (
+	exifOrientationTag = 0x0112
+	exifArtistTag      = 0x013B
+	exifCopyrightTag   = 0x8298
+	exifTypeASCII      = 2
+	exifTypeShort      = 3
+)
+
+var exifHeader = []byte("Exif\x00\x00")
+
+//findExif returns the tiff structure of the exif segment of a jpeg image
+//nil is returned if the image has no exif segment
+func findExif(data []byte) []byte {
+	var result []byte
+	jpegSegments(data, func(marker byte, content []byte) {
+		if result == nil && marker == jpegMarkerAPP1 && bytes.HasPrefix(content, exifHeader) {
+			result = content[len(exifHeader):]
+		}
+	})
+
+	return result
+}
+
+//exifByteOrder returns the byte order of a tiff structure
+func exifByteOrder(tiff []byte) (binary.ByteOrder, bool) {
+	if len(tiff) < 8 {
+		return nil, false
+	}
+
+	switch string(tiff[:2]) {
+	case "II":
+		return binary.LittleEndian, true
+	case "MM":
+		return binary.BigEndian, true
+	default:
+		return nil, false
+	}
+}
+
+//exifEntry returns the offset of the entry with the given tag in the first ifd of a tiff structure
+func exifEntry(tiff []byte, order binary.ByteOrder, tag uint16) (int, bool) {
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0, false
+	}
+
+	count := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < count; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 0, false
+		}
+
+		if order.Uint16(tiff[entry:]) == tag {
+			return entry, true
+		}
+	}
+
+	return 0, false
+}
+
+//exifOrientation returns the orientation of the first ifd of a tiff structure
+//images without a valid orientation are considered upright and 1 is returned
+func exifOrientation(tiff []byte) int {
+	order, ok := exifByteOrder(tiff)
+	if !ok {
+		return 1
+	}
+
+	entry, found := exifEntry(tiff, order, exifOrientationTag)
+	if !found || order.Uint16(tiff[entry+2:]) != exifTypeShort {
+		return 1
+	}
+
+	orientation := int(order.Uint16(tiff[entry+8:]))
+	if orientation < 1 || orientation > 8 {
+		return 1
+	}
+
+	return orientation
+}
+
+//exifASCII returns the value of a text tag in the first ifd of a tiff structure
+func exifASCII(tiff []byte, order binary.ByteOrder, tag uint16) []byte {
+	entry, found := exifEntry(tiff, order, tag)
+	if !found || order.Uint16(tiff[entry+2:]) != exifTypeASCII {
+		return nil
+	}
+
+	count := int(order.Uint32(tiff[entry+4:]))
+	offset := entry + 8
+	if count > 4 {
+		offset = int(order.Uint32(tiff[entry+8:]))
+	}
+
+	if count <= 0 || offset < 0 || offset+count > len(tiff) {
+		return nil
+	}
+
+	return append([]byte{}, tiff[offset:offset+count]...)
+}
+
+//copyrightExif returns a new tiff structure, which only contains the artist and the copyright of the given one
+//nil is returned if neither of them is set
+func copyrightExif(tiff []byte) []byte {
+	order, ok := exifByteOrder(tiff)
+	if !ok {
+		return nil
+	}
+
+	tags := []uint16{}
+	values := [][]byte{}
+	// entries must be sorted by their tag
+	for _, tag := range []uint16{exifArtistTag, exifCopyrightTag} {
+		if value := exifASCII(tiff, order, tag); value != nil {
+			tags = append(tags, tag)
+			values = append(values, value)
+		}
+	}
+
+	if len(tags) == 0 {
+		return nil
+	}
+
+	var result bytes.Buffer
+	result.WriteString("MM\x00\x2a")
+	binary.Write(&result, binary.BigEndian, uint32(8))
+	binary.Write(&result, binary.BigEndian, uint16(len(tags)))
+
+	data := 8 + 2 + 12*len(tags) + 4
+	var area bytes.Buffer
+	for i, tag := range tags {
+		binary.Write(&result, binary.BigEndian, tag)
+		binary.Write(&result, binary.BigEndian, uint16(exifTypeASCII))
+		binary.Write(&result, binary.BigEndian, uint32(len(values[i])))
+		if len(values[i]) <= 4 {
+			value := make([]byte, 4)
+			copy(value, values[i])
+			result.Write(value)
+			continue
+		}
+
+		binary.Write(&result, binary.BigEndian, uint32(data+area.Len()))
+		area.Write(values[i])
+		// values start at word boundaries
+		if area.Len()%2 == 1 {
+			area.WriteByte(0)
+		}
+	}
+
+	// there is no next ifd
+	binary.Write(&result, binary.BigEndian, uint32(0))
+	result.Write(area.Bytes())
+
+	return result.Bytes()
+}
+
+//orient rotates and flips an image with the given exif orientation, so it will be upright
+func orient(img image.Image, orientation int) image.Image {
+	switch orientation {
+	case 2:
+		return imaging.FlipH(img)
+	case 3:
+		return imaging.Rotate180(img)
+	case 4:
+		return imaging.FlipV(img)
+	case 5:
+		return imaging.Transpose(img)
+	case 6:
+		return imaging.Rotate270(img)
+	case 7:
+		return imaging.Transverse(img)
+	case 8:
+		return imaging.Rotate90(img)
+	default:
+		return img
+	}
+}
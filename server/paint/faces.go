@@ -0,0 +1,171 @@
+package paint
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//FacesKey is the metadata key of the faces that have been detected in an original with the default detection size
+const FacesKey = "faces"
+
+//FacesMetaKey returns the metadata key of the faces that have been detected with detectionSize,
+//small faces might not be found in smaller images, so the faces of every detection size are stored separately
+func FacesMetaKey(detectionSize int) string {
+	if detectionSize <= 0 {
+		return FacesKey
+	}
+
+	return fmt.Sprintf("%s_%d", FacesKey, detectionSize)
+}
+
+//IsFacesKey returns true if key is the metadata key of faces of any detection size
+func IsFacesKey(key string) bool {
+	key = strings.ToLower(key)
+	if key == FacesKey {
+		return true
+	}
+
+	size, err := strconv.Atoi(strings.TrimPrefix(key, FacesKey+"_"))
+	return strings.HasPrefix(key, FacesKey+"_") && err == nil && size > 0
+}
+
+//Face is the rectangle of a face in the coordinates of the original,
+//it is used to store faces in metadata and to return them as json
+type Face struct {
+	X      int `json:"x" bson:"x"`
+	Y      int `json:"y" bson:"y"`
+	Width  int `json:"width" bson:"width"`
+	Height int `json:"height" bson:"height"`
+}
+
+//FaceDetector returns all faces of an image in its coordinates, regardless of their size.
+//Resizers that implement it get the faces passed in FaceOptions.Detected, so they can be cached
+type FaceDetector interface {
+	DetectFaces(input image.Image, options FaceOptions) ([]image.Rectangle, error)
+}
+
+var faceDetector FaceDetector
+var faceDetectorLock = sync.Mutex{}
+
+//SetFaceDetector registers the detector that is used to return the faces of images
+func SetFaceDetector(detector FaceDetector) {
+	faceDetectorLock.Lock()
+	defer faceDetectorLock.Unlock()
+	log.Println("Registering face detector")
+	faceDetector = detector
+}
+
+//GetFaceDetector returns the registered face detector, or nil if there is none
+func GetFaceDetector() FaceDetector {
+	faceDetectorLock.Lock()
+	defer faceDetectorLock.Unlock()
+
+	return faceDetector
+}
+
+//NewFaces converts rectangles into faces, it never returns nil
+func NewFaces(rectangles []image.Rectangle) []Face {
+	faces := make([]Face, 0, len(rectangles))
+	for _, r := range rectangles {
+		faces = append(faces, Face{X: r.Min.X, Y: r.Min.Y, Width: r.Dx(), Height: r.Dy()})
+	}
+
+	return faces
+}
+
+//Rectangle returns the rectangle of the face
+func (f Face) Rectangle() image.Rectangle {
+	return image.Rect(f.X, f.Y, f.X+f.Width, f.Y+f.Height)
+}
+
+//CachedFaces are the faces of an original that are stored in its metadata.
+//Original is the cache identifier of the original they have been detected in,
+//so faces of a replaced original will not be reused
+type CachedFaces struct {
+	Original string `json:"original" bson:"original"`
+	Faces    []Face `json:"faces" bson:"faces"`
+}
+
+//NewCachedFaces returns the faces that have been detected in the original with the given cache identifier
+func NewCachedFaces(original string, rectangles []image.Rectangle) CachedFaces {
+	return CachedFaces{Original: original, Faces: NewFaces(rectangles)}
+}
+
+//FacesFromMeta returns the faces of detectionSize stored in metadata, found is false if no faces have been stored
+//or if they have been detected in another version of the original than the one with the given cache identifier.
+//Every storage decodes them differently, so they are converted via json
+func FacesFromMeta(meta map[string]interface{}, detectionSize int, original string) (rectangles []image.Rectangle, found bool) {
+	value, _ := MetaValue(meta, FacesMetaKey(detectionSize))
+	if value == nil {
+		return nil, false
+	}
+
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return nil, false
+	}
+
+	var cached CachedFaces
+	if err := json.Unmarshal(encoded, &cached); err != nil || cached.Faces == nil || cached.Original != original {
+		return nil, false
+	}
+
+	rectangles = make([]image.Rectangle, 0, len(cached.Faces))
+	for _, face := range cached.Faces {
+		rectangles = append(rectangles, face.Rectangle())
+	}
+
+	return rectangles, true
+}
+
+//FrameFaces returns the rectangle within bounds with the ratio of dstWidth and dstHeight that frames all faces.
+//The union of all faces is enlarged by padding, which is a fraction of its size on every side,
+//and expanded to the ratio. It is not smaller than dstWidth and dstHeight, as long as the bounds are large enough.
+//If it does not fit into the bounds, it will be shrunk while keeping the ratio, and moved into the bounds.
+func FrameFaces(bounds image.Rectangle, faces []image.Rectangle, dstWidth, dstHeight int, padding float64) image.Rectangle {
+	if len(faces) == 0 {
+		center := image.Pt(bounds.Min.X+bounds.Dx()/2, bounds.Min.Y+bounds.Dy()/2)
+		return cropRectangle(bounds, dstWidth, dstHeight, center)
+	}
+
+	union := faces[0]
+	for _, face := range faces[1:] {
+		union = union.Union(face)
+	}
+
+	ratio := float64(dstWidth) / float64(dstHeight)
+	width := float64(union.Dx()) * (1 + 2*padding)
+	height := float64(union.Dy()) * (1 + 2*padding)
+	if width/height < ratio {
+		width = height * ratio
+	} else {
+		height = width / ratio
+	}
+
+	// resized images should not be scaled up
+	if width < float64(dstWidth) {
+		width, height = float64(dstWidth), float64(dstHeight)
+	}
+
+	if width > float64(bounds.Dx()) {
+		width, height = float64(bounds.Dx()), float64(bounds.Dx())/ratio
+	}
+
+	if height > float64(bounds.Dy()) {
+		width, height = float64(bounds.Dy())*ratio, float64(bounds.Dy())
+	}
+
+	size := image.Pt(clamp(int(width+0.5), 1, bounds.Dx()), clamp(int(height+0.5), 1, bounds.Dy()))
+	center := image.Pt(union.Min.X+union.Dx()/2, union.Min.Y+union.Dy()/2)
+	min := image.Pt(
+		clamp(center.X-size.X/2, bounds.Min.X, bounds.Max.X-size.X),
+		clamp(center.Y-size.Y/2, bounds.Min.Y, bounds.Max.Y-size.Y),
+	)
+
+	return image.Rectangle{Min: min, Max: min.Add(size)}
+}
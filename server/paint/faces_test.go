@@ -0,0 +1,83 @@
+package paint_test
+
+import (
+	"image"
+
+	. "github.com/VoycerAG/gridfs-image-server/server/paint"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Framing faces", func() {
+	ratio := func(r image.Rectangle) float64 {
+		return float64(r.Dx()) / float64(r.Dy())
+	}
+
+	It("should frame all faces with the ratio of the target", func() {
+		bounds := image.Rect(0, 0, 1000, 1000)
+		faces := []image.Rectangle{image.Rect(100, 100, 200, 200), image.Rect(600, 150, 700, 250)}
+
+		frame := FrameFaces(bounds, faces, 400, 200, 0.25)
+		Expect(frame.In(bounds)).To(BeTrue())
+		Expect(ratio(frame)).To(BeNumerically("~", 2, 0.01))
+		for _, face := range faces {
+			Expect(face.In(frame)).To(BeTrue())
+		}
+	})
+
+	It("should keep the ratio and stay within the bounds", func() {
+		bounds := image.Rect(0, 0, 1000, 500)
+		faces := []image.Rectangle{image.Rect(0, 0, 300, 300), image.Rect(800, 100, 1000, 300)}
+
+		frame := FrameFaces(bounds, faces, 300, 100, 0.25)
+		Expect(frame.In(bounds)).To(BeTrue())
+		Expect(ratio(frame)).To(BeNumerically("~", 3, 0.01))
+		Expect(frame.Dx()).To(Equal(1000))
+
+		frame = FrameFaces(bounds, []image.Rectangle{image.Rect(0, 0, 50, 50)}, 100, 100, 0.25)
+		Expect(frame).To(Equal(image.Rect(0, 0, 100, 100)))
+	})
+
+	It("should respect the origin of the bounds", func() {
+		bounds := image.Rect(100, 100, 600, 600)
+		frame := FrameFaces(bounds, []image.Rectangle{image.Rect(500, 500, 600, 600)}, 50, 50, 0)
+		Expect(frame).To(Equal(image.Rect(500, 500, 600, 600)))
+
+		frame = FrameFaces(bounds, nil, 100, 50, 0)
+		Expect(frame).To(Equal(image.Rect(100, 225, 600, 475)))
+	})
+
+	It("should store the faces of every detection size separately", func() {
+		Expect(FacesMetaKey(0)).To(Equal(FacesKey))
+		Expect(FacesMetaKey(512)).To(Equal("faces_512"))
+		for _, key := range []string{"faces", "Faces", "faces_512"} {
+			Expect(IsFacesKey(key)).To(BeTrue(), key)
+		}
+		for _, key := range []string{"facesCount", "faces_", "faces_-1", "copyright"} {
+			Expect(IsFacesKey(key)).To(BeFalse(), key)
+		}
+
+		meta := map[string]interface{}{"faces_512": NewCachedFaces("md5", []image.Rectangle{image.Rect(1, 2, 4, 6)})}
+		_, found := FacesFromMeta(meta, 0, "md5")
+		Expect(found).To(BeFalse())
+		faces, found := FacesFromMeta(meta, 512, "md5")
+		Expect(found).To(BeTrue())
+		Expect(faces).To(Equal([]image.Rectangle{image.Rect(1, 2, 4, 6)}))
+	})
+
+	It("should ignore faces of another version of the original", func() {
+		meta := map[string]interface{}{"faces": NewCachedFaces("md5", []image.Rectangle{image.Rect(1, 2, 4, 6)})}
+		_, found := FacesFromMeta(meta, 0, "replaced")
+		Expect(found).To(BeFalse())
+
+		meta = map[string]interface{}{"faces": []Face{{X: 1, Y: 2, Width: 3, Height: 4}}}
+		_, found = FacesFromMeta(meta, 0, "md5")
+		Expect(found).To(BeFalse())
+
+		meta = map[string]interface{}{"faces": NewCachedFaces("md5", nil)}
+		faces, found := FacesFromMeta(meta, 0, "md5")
+		Expect(found).To(BeTrue())
+		Expect(faces).To(BeEmpty())
+	})
+})
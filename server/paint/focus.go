@@ -0,0 +1,119 @@
+package paint
+
+import (
+	"image"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+const (
+	//FocusXKey is the metadata key of the horizontal focal point as fraction of the width
+	FocusXKey = "focusX"
+	//FocusYKey is the metadata key of the vertical focal point as fraction of the height
+	FocusYKey = "focusY"
+)
+
+//FocusResizer scales the image down and crops it around the focal point of the original's metadata
+//images without a focal point are cropped around their center
+type FocusResizer struct {
+}
+
+//Resize with mode focus, the image will be cropped around its center
+//errors only if dstWidth or dstHeight is invalid
+func (f FocusResizer) Resize(input image.Image, dstWidth, dstHeight int) (image.Image, error) {
+	return f.ResizeWithOptions(input, dstWidth, dstHeight, ResizeOptions{})
+}
+
+//ResizeWithOptions crops the image around the focal point of options.Meta
+func (f FocusResizer) ResizeWithOptions(input image.Image, dstWidth, dstHeight int, options ResizeOptions) (image.Image, error) {
+	// if the ratio is kept, there is nothing to crop
+	if dstWidth < 0 || dstHeight < 0 {
+		return CropResizer{}.Resize(input, dstWidth, dstHeight)
+	}
+
+	bounds := input.Bounds()
+	focus := image.Pt(bounds.Min.X+bounds.Dx()/2, bounds.Min.Y+bounds.Dy()/2)
+	x, foundX := metaFraction(options.Meta, FocusXKey)
+	y, foundY := metaFraction(options.Meta, FocusYKey)
+	if foundX && foundY {
+		focus = image.Pt(bounds.Min.X+int(x*float64(bounds.Dx())), bounds.Min.Y+int(y*float64(bounds.Dy())))
+	}
+
+	cropped := imaging.Crop(input, cropRectangle(bounds, dstWidth, dstHeight, focus))
+	return imaging.Resize(cropped, dstWidth, dstHeight, imaging.Lanczos), nil
+}
+
+//cropRectangle returns the largest rectangle within bounds with the ratio of dstWidth and dstHeight,
+//it is centered around center as far as the bounds allow
+func cropRectangle(bounds image.Rectangle, dstWidth, dstHeight int, center image.Point) image.Rectangle {
+	width, height := bounds.Dx(), bounds.Dy()
+	if dstWidth*height > dstHeight*width {
+		height = width * dstHeight / dstWidth
+	} else {
+		width = height * dstWidth / dstHeight
+	}
+
+	min := image.Pt(clamp(center.X-width/2, bounds.Min.X, bounds.Max.X-width), clamp(center.Y-height/2, bounds.Min.Y, bounds.Max.Y-height))
+	return image.Rectangle{Min: min, Max: min.Add(image.Pt(width, height))}
+}
+
+func clamp(value, min, max int) int {
+	if value < min {
+		return min
+	}
+
+	if value > max {
+		return max
+	}
+
+	return value
+}
+
+//metaFraction returns a value between 0 and 1 from metadata,
+//numbers can be stored as numbers or strings and keys might be lowercased depending on the storage
+func metaFraction(meta map[string]interface{}, key string) (float64, bool) {
+	var result float64
+	value, _ := MetaValue(meta, key)
+	switch value := value.(type) {
+	case float64:
+		result = value
+	case float32:
+		result = float64(value)
+	case int:
+		result = float64(value)
+	case int64:
+		result = float64(value)
+	case string:
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return 0, false
+		}
+		result = parsed
+	default:
+		return 0, false
+	}
+
+	if result < 0 || result > 1 {
+		return 0, false
+	}
+
+	return result, true
+}
+
+//MetaValue returns the value of key and whether it has been found,
+//the case of the key is ignored because some storages do not preserve it
+func MetaValue(meta map[string]interface{}, key string) (interface{}, bool) {
+	if value, found := meta[key]; found {
+		return value, true
+	}
+
+	for k, value := range meta {
+		if strings.EqualFold(k, key) {
+			return value, true
+		}
+	}
+
+	return nil, false
+}
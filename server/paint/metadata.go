@@ -0,0 +1,283 @@
+package paint
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"sort"
+)
+
+//MetadataPolicy defines which metadata of the original is kept in resized images
+type MetadataPolicy string
+
+const (
+	//MetadataStrip removes all metadata and is used if nothing else is specified
+	MetadataStrip MetadataPolicy = "strip"
+	//MetadataICC keeps the icc color profile
+	MetadataICC MetadataPolicy = "icc"
+	//MetadataCopyright keeps the icc color profile, the artist and the copyright
+	MetadataCopyright MetadataPolicy = "copyright"
+)
+
+//IsValidMetadataPolicy returns true if policy is known, an empty policy is valid as well
+func IsValidMetadataPolicy(policy MetadataPolicy) bool {
+	switch policy {
+	case "", MetadataStrip, MetadataICC, MetadataCopyright:
+		return true
+	default:
+		return false
+	}
+}
+
+const (
+	jpegMarkerSOI  = 0xD8
+	jpegMarkerSOS  = 0xDA
+	jpegMarkerAPP1 = 0xE1
+	jpegMarkerAPP2 = 0xE2
+
+	// a jpeg segment contains at most 65533 bytes, the icc header and the chunk numbers are subtracted
+	maxICCChunk = 65533 - 14
+
+	// larger png chunks before the image data are not searched for metadata
+	maxPNGMetadataChunk = 16 << 20
+
+	pngSignature = "\x89PNG\r\n\x1a\n"
+)
+
+var iccHeader = []byte("ICC_PROFILE\x00")
+
+//metadata contains the icc profile and the exif tiff structure of an original
+type metadata struct {
+	icc  []byte
+	exif []byte
+}
+
+//filter returns the metadata that will be kept with the given policy
+//exif is rebuilt with the artist and copyright only, all other tags like gps coordinates are dropped
+func (m metadata) filter(policy MetadataPolicy) metadata {
+	switch policy {
+	case MetadataICC:
+		return metadata{icc: m.icc}
+	case MetadataCopyright:
+		return metadata{icc: m.icc, exif: copyrightExif(m.exif)}
+	default:
+		return metadata{}
+	}
+}
+
+func (m metadata) empty() bool {
+	return len(m.icc) == 0 && len(m.exif) == 0
+}
+
+//jpegSegments calls segment for every segment of a jpeg image until the image data starts
+func jpegSegments(data []byte, segment func(marker byte, content []byte)) {
+	if len(data) < 2 || data[0] != 0xFF || data[1] != jpegMarkerSOI {
+		return
+	}
+
+	for offset := 2; offset+4 <= len(data); {
+		if data[offset] != 0xFF {
+			return
+		}
+
+		marker := data[offset+1]
+		if marker == jpegMarkerSOS {
+			return
+		}
+
+		length := int(binary.BigEndian.Uint16(data[offset+2:]))
+		end := offset + 2 + length
+		if length < 2 || end > len(data) {
+			return
+		}
+
+		segment(marker, data[offset+4:end])
+		offset = end
+	}
+}
+
+//readJPEGMetadata returns the metadata of a jpeg image,
+//data must contain at least all segments before the frame header
+func readJPEGMetadata(data []byte) metadata {
+	result := metadata{exif: findExif(data)}
+
+	chunks := map[int][]byte{}
+	jpegSegments(data, func(marker byte, content []byte) {
+		if marker == jpegMarkerAPP2 && bytes.HasPrefix(content, iccHeader) && len(content) > len(iccHeader)+2 {
+			chunks[int(content[len(iccHeader)])] = content[len(iccHeader)+2:]
+		}
+	})
+
+	sequence := []int{}
+	for number := range chunks {
+		sequence = append(sequence, number)
+	}
+	sort.Ints(sequence)
+
+	for _, number := range sequence {
+		result.icc = append(result.icc, chunks[number]...)
+	}
+
+	return result
+}
+
+//readPNGMetadata returns the metadata of a png image, all chunks before the image data
+//will be read from data into header, so the image can be decoded afterwards
+func readPNGMetadata(header *bytes.Buffer, data io.Reader) metadata {
+	result := metadata{}
+	for offset := len(pngSignature); ; {
+		if fill(header, data, offset+8) != nil {
+			return result
+		}
+
+		length := int(binary.BigEndian.Uint32(header.Bytes()[offset:]))
+		chunkType := string(header.Bytes()[offset+4 : offset+8])
+		if chunkType == "IDAT" || chunkType == "IEND" || length > maxPNGMetadataChunk {
+			return result
+		}
+
+		end := offset + 12 + length
+		if fill(header, data, end) != nil {
+			return result
+		}
+
+		content := header.Bytes()[offset+8 : offset+8+length]
+		switch chunkType {
+		case "iCCP":
+			result.icc = readICCPChunk(content)
+		case "eXIf":
+			result.exif = append([]byte{}, content...)
+		}
+
+		offset = end
+	}
+}
+
+//fill reads from data into buffer until it contains at least size bytes
+func fill(buffer *bytes.Buffer, data io.Reader, size int) error {
+	if buffer.Len() >= size {
+		return nil
+	}
+
+	_, err := io.CopyN(buffer, data, int64(size-buffer.Len()))
+	return err
+}
+
+//readICCPChunk returns the uncompressed profile of an iCCP chunk
+func readICCPChunk(content []byte) []byte {
+	separator := bytes.IndexByte(content, 0)
+	if separator < 0 || separator+2 > len(content) || content[separator+1] != 0 {
+		return nil
+	}
+
+	reader, err := zlib.NewReader(bytes.NewReader(content[separator+2:]))
+	if err != nil {
+		return nil
+	}
+	defer reader.Close()
+
+	profile, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil
+	}
+
+	return profile
+}
+
+//encodeJPEG encodes img and adds the metadata segments after the start of image marker
+func encodeJPEG(target io.Writer, img image.Image, quality int, meta metadata) error {
+	if meta.empty() {
+		return jpeg.Encode(target, img, &jpeg.Options{Quality: quality})
+	}
+
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, img, &jpeg.Options{Quality: quality}); err != nil {
+		return err
+	}
+
+	var segments bytes.Buffer
+	if len(meta.exif) > 0 {
+		writeJPEGSegment(&segments, jpegMarkerAPP1, exifHeader, meta.exif)
+	}
+
+	count := (len(meta.icc) + maxICCChunk - 1) / maxICCChunk
+	for i := 0; i < count; i++ {
+		end := (i + 1) * maxICCChunk
+		if end > len(meta.icc) {
+			end = len(meta.icc)
+		}
+
+		header := append(append([]byte{}, iccHeader...), byte(i+1), byte(count))
+		writeJPEGSegment(&segments, jpegMarkerAPP2, header, meta.icc[i*maxICCChunk:end])
+	}
+
+	return writeAll(target, encoded.Bytes()[:2], segments.Bytes(), encoded.Bytes()[2:])
+}
+
+func writeJPEGSegment(target *bytes.Buffer, marker byte, header, content []byte) {
+	target.Write([]byte{0xFF, marker})
+	binary.Write(target, binary.BigEndian, uint16(2+len(header)+len(content)))
+	target.Write(header)
+	target.Write(content)
+}
+
+//encodePNG encodes img and adds the metadata chunks after the image header
+func encodePNG(target io.Writer, encoder png.Encoder, img image.Image, meta metadata) error {
+	if meta.empty() {
+		return encoder.Encode(target, img)
+	}
+
+	var encoded bytes.Buffer
+	if err := encoder.Encode(&encoded, img); err != nil {
+		return err
+	}
+
+	// the signature is followed by the image header with 13 bytes of content
+	headerEnd := len(pngSignature) + 12 + 13
+	if encoded.Len() < headerEnd {
+		return fmt.Errorf("invalid png image")
+	}
+
+	var chunks bytes.Buffer
+	if len(meta.icc) > 0 {
+		var profile bytes.Buffer
+		profile.WriteString("ICC Profile\x00\x00")
+		compressor := zlib.NewWriter(&profile)
+		compressor.Write(meta.icc)
+		if err := compressor.Close(); err != nil {
+			return err
+		}
+
+		writePNGChunk(&chunks, "iCCP", profile.Bytes())
+	}
+
+	if len(meta.exif) > 0 {
+		writePNGChunk(&chunks, "eXIf", meta.exif)
+	}
+
+	return writeAll(target, encoded.Bytes()[:headerEnd], chunks.Bytes(), encoded.Bytes()[headerEnd:])
+}
+
+func writePNGChunk(target *bytes.Buffer, chunkType string, content []byte) {
+	binary.Write(target, binary.BigEndian, uint32(len(content)))
+	checksum := crc32.NewIEEE()
+	io.MultiWriter(target, checksum).Write(append([]byte(chunkType), content...))
+	binary.Write(target, binary.BigEndian, checksum.Sum32())
+}
+
+func writeAll(target io.Writer, parts ...[]byte) error {
+	for _, part := range parts {
+		if _, err := target.Write(part); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,130 @@
+package paint
+
+import (
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"strings"
+)
+
+//Alignment defines where an image will be placed if it does not fill the whole box
+type Alignment string
+
+const (
+	//AlignCenter centers the image and is used if nothing else is specified
+	AlignCenter Alignment = "center"
+	//AlignTop places the image at the top center
+	AlignTop Alignment = "top"
+	//AlignBottom places the image at the bottom center
+	AlignBottom Alignment = "bottom"
+	//AlignLeft places the image at the left center
+	AlignLeft Alignment = "left"
+	//AlignRight places the image at the right center
+	AlignRight Alignment = "right"
+	//AlignTopLeft places the image at the top left corner
+	AlignTopLeft Alignment = "top-left"
+	//AlignTopRight places the image at the top right corner
+	AlignTopRight Alignment = "top-right"
+	//AlignBottomLeft places the image at the bottom left corner
+	AlignBottomLeft Alignment = "bottom-left"
+	//AlignBottomRight places the image at the bottom right corner
+	AlignBottomRight Alignment = "bottom-right"
+)
+
+//alignmentFactors contains the horizontal and vertical position of every alignment
+//in halves of the remaining space, 0 is left or top, 2 is right or bottom
+var alignmentFactors = map[Alignment][2]int{
+	"":               {1, 1},
+	AlignCenter:      {1, 1},
+	AlignTop:         {1, 0},
+	AlignBottom:      {1, 2},
+	AlignLeft:        {0, 1},
+	AlignRight:       {2, 1},
+	AlignTopLeft:     {0, 0},
+	AlignTopRight:    {2, 0},
+	AlignBottomLeft:  {0, 2},
+	AlignBottomRight: {2, 2},
+}
+
+//IsValidAlignment returns true if alignment is known, an empty alignment is valid as well
+func IsValidAlignment(alignment Alignment) bool {
+	_, found := alignmentFactors[alignment]
+	return found
+}
+
+//offset returns the position of an image with the given size within the box
+func (a Alignment) offset(size, box image.Point) image.Point {
+	factors := alignmentFactors[a]
+	return image.Pt((box.X-size.X)*factors[0]/2, (box.Y-size.Y)*factors[1]/2)
+}
+
+//ResizeOptions are passed to resizers that implement OptionsResizer
+//Background is used to fill the remainder of the box, nil is transparent.
+//Alignment places the resized image within the box.
+//Meta contains the metadata of the original, e.g. its focal point.
+//Faces configure resizers that detect faces.
+type ResizeOptions struct {
+	Background color.Color
+	Alignment  Alignment
+	Meta       map[string]interface{}
+	Faces      FaceOptions
+}
+
+//FaceOptions configure resizers that detect faces, zero values use the defaults of the resizer
+//MinArea is the fraction of the image a face must cover, smaller faces are ignored.
+//DetectionSize is the maximum width or height of the image during the detection.
+//Padding is the fraction of the size of all faces, that is added on every side.
+//Fallback is used to resize images without faces.
+//Detected contains the faces of the image, if they are already known, nil lets the resizer detect them.
+type FaceOptions struct {
+	MinArea       float64
+	DetectionSize int
+	Padding       *float64
+	Fallback      ResizeType
+	Detected      []image.Rectangle
+}
+
+//OptionsResizer is a Resizer that can be configured per resize
+type OptionsResizer interface {
+	Resizer
+	ResizeWithOptions(input image.Image, dstWidth, dstHeight int, options ResizeOptions) (image.Image, error)
+}
+
+//ResizeWithOptions passes the options to resizers that support them
+func ResizeWithOptions(resizer Resizer, input image.Image, dstWidth, dstHeight int, options ResizeOptions) (image.Image, error) {
+	if optionsResizer, ok := resizer.(OptionsResizer); ok {
+		return optionsResizer.ResizeWithOptions(input, dstWidth, dstHeight, options)
+	}
+
+	return resizer.Resize(input, dstWidth, dstHeight)
+}
+
+//ParseColor parses colors in the hex notation #rrggbb or #rrggbbaa,
+//transparent and an empty string result in a transparent color
+func ParseColor(value string) (color.Color, error) {
+	if value == "" || value == "transparent" {
+		return color.Transparent, nil
+	}
+
+	components, err := hex.DecodeString(strings.TrimPrefix(value, "#"))
+	if err != nil || (len(components) != 3 && len(components) != 4) {
+		return nil, fmt.Errorf("invalid color %s", value)
+	}
+
+	if len(components) == 3 {
+		components = append(components, 0xff)
+	}
+
+	return color.NRGBA{R: components[0], G: components[1], B: components[2], A: components[3]}, nil
+}
+
+//DefaultBackground returns the background for images encoded to format
+//if none is configured, formats without transparency get a white background
+func DefaultBackground(format string) color.Color {
+	if format == "jpeg" {
+		return color.White
+	}
+
+	return color.Transparent
+}
@@ -3,6 +3,8 @@ package paint
 import (
 	"fmt"
 	"image"
+	"image/color"
+	"image/draw"
 	"log"
 	"sync"
 
@@ -17,9 +19,12 @@ type ResizeType string
 //of all available resize types
 //simply check with _, found := AvaiableResizeTypes[ResizeType]
 var defaultAvailableResizeTypes = map[ResizeType]ResizeType{
-	TypeResize: TypeResize,
-	TypeCrop:   TypeCrop,
-	TypeFit:    TypeFit,
+	TypeResize:   TypeResize,
+	TypeCrop:     TypeCrop,
+	TypeFit:      TypeFit,
+	TypePad:      TypePad,
+	TypeFocus:    TypeFocus,
+	TypeSaliency: TypeSaliency,
 }
 
 var extraAllowedTypes = map[ResizeType]Resizer{}
@@ -32,6 +37,12 @@ const (
 	TypeCrop ResizeType = "crop"
 	//TypeFit will resize the image according to the original ratio, but will not exceed the given bounds
 	TypeFit ResizeType = "fit"
+	//TypePad will fit the image into the given bounds and fill the remainder with a background color
+	TypePad ResizeType = "pad"
+	//TypeFocus will generate an image with exact sizes, cropped around the focal point of the original
+	TypeFocus ResizeType = "focus"
+	//TypeSaliency will generate an image with exact sizes, cropped to the part with the most content
+	TypeSaliency ResizeType = "saliency"
 )
 
 //AddResizer allows a custom resizer to use
@@ -42,11 +53,22 @@ func AddResizer(resizeType ResizeType, resizer Resizer) {
 	extraAllowedTypes[resizeType] = resizer
 }
 
+//RemoveResizer removes a custom resizer, e.g. after tests
+func RemoveResizer(resizeType ResizeType) {
+	extraResizerLock.Lock()
+	defer extraResizerLock.Unlock()
+	delete(extraAllowedTypes, resizeType)
+}
+
 //GetAvailableTypes returns all available types
 func GetAvailableTypes() map[ResizeType]ResizeType {
 	extraResizerLock.Lock()
 	defer extraResizerLock.Unlock()
-	result := defaultAvailableResizeTypes
+	result := map[ResizeType]ResizeType{}
+	for rtype := range defaultAvailableResizeTypes {
+		result[rtype] = rtype
+	}
+
 	for rtype := range extraAllowedTypes {
 		result[rtype] = rtype
 	}
@@ -54,12 +76,17 @@ func GetAvailableTypes() map[ResizeType]ResizeType {
 	return result
 }
 
-//GetCustomResizers returns a read only list of custom resizers
+//GetCustomResizers returns a copy of all custom resizers
 func GetCustomResizers() map[ResizeType]Resizer {
 	extraResizerLock.Lock()
 	defer extraResizerLock.Unlock()
 
-	return extraAllowedTypes
+	result := make(map[ResizeType]Resizer, len(extraAllowedTypes))
+	for rtype, resizer := range extraAllowedTypes {
+		result[rtype] = resizer
+	}
+
+	return result
 }
 
 //Resizer can resize an image
@@ -69,14 +96,23 @@ type Resizer interface {
 	Resize(input image.Image, dstWidth, dstHeight int) (image.Image, error)
 }
 
+//NewResizer returns the resizer for the given type, including custom resizers
+//if an invalid type was given a PlainResizer will be returned
+func NewResizer(resizeType ResizeType) Resizer {
+	return newResizerByType(resizeType, GetCustomResizers())
+}
+
 //newResizerByType returns a resizer for the given
 //type. If an invalid type was given
 //a PlainResizer will be created
 func newResizerByType(resizeType ResizeType, customResizer map[ResizeType]Resizer) Resizer {
 	resizers := map[ResizeType]Resizer{
-		TypeResize: PlainResizer{},
-		TypeFit:    FitResizer{},
-		TypeCrop:   CropResizer{},
+		TypeResize:   PlainResizer{},
+		TypeFit:      FitResizer{},
+		TypeCrop:     CropResizer{},
+		TypePad:      PadResizer{},
+		TypeFocus:    FocusResizer{},
+		TypeSaliency: SaliencyResizer{},
 	}
 
 	for rtype, resizer := range customResizer {
@@ -169,3 +205,39 @@ func (c CropResizer) Resize(input image.Image, dstWidth, dstHeight int) (image.I
 
 	return imaging.Thumbnail(input, dstWidth, dstHeight, imaging.Lanczos), nil
 }
+
+//PadResizer fits the image into the given bounding box and fills the remainder with the background
+type PadResizer struct {
+}
+
+//Resize with mode pad. The remainder will be transparent and the image will be centered
+//errors only if dstWidth or dstHeight is invalid
+func (p PadResizer) Resize(input image.Image, dstWidth, dstHeight int) (image.Image, error) {
+	return p.ResizeWithOptions(input, dstWidth, dstHeight, ResizeOptions{})
+}
+
+//ResizeWithOptions fills the remainder with the background and places the image according to the alignment
+func (p PadResizer) ResizeWithOptions(input image.Image, dstWidth, dstHeight int, options ResizeOptions) (image.Image, error) {
+	if dstWidth <= 0 || dstHeight <= 0 {
+		return nil, fmt.Errorf("Please specify both width and height for your target image")
+	}
+
+	fitted, err := FitResizer{}.Resize(input, dstWidth, dstHeight)
+	if err != nil {
+		return nil, err
+	}
+
+	background := options.Background
+	if background == nil {
+		background = color.Transparent
+	}
+
+	result := image.NewNRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+	draw.Draw(result, result.Bounds(), image.NewUniform(background), image.ZP, draw.Src)
+
+	size := fitted.Bounds().Size()
+	offset := options.Alignment.offset(size, result.Bounds().Size())
+	draw.Draw(result, image.Rectangle{Min: offset, Max: offset.Add(size)}, fitted, fitted.Bounds().Min, draw.Over)
+
+	return result, nil
+}
@@ -0,0 +1,21 @@
+package paint_test
+
+import (
+	. "github.com/VoycerAG/gridfs-image-server/server/paint"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Custom resizers", func() {
+	It("can be added and removed again", func() {
+		AddResizer("custom", PlainResizer{})
+		Expect(GetAvailableTypes()).To(HaveKey(ResizeType("custom")))
+		Expect(GetCustomResizers()).To(HaveKey(ResizeType("custom")))
+
+		RemoveResizer("custom")
+		Expect(GetAvailableTypes()).ToNot(HaveKey(ResizeType("custom")))
+		Expect(GetAvailableTypes()).To(HaveKey(TypeCrop))
+		Expect(GetCustomResizers()).ToNot(HaveKey(ResizeType("custom")))
+	})
+})
@@ -0,0 +1,189 @@
+package paint
+
+import (
+	"image"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+const (
+	// images are analyzed with at most this size, the crop is applied to the full image
+	saliencyAnalysisSize = 256
+
+	saliencyEdgeWeight       = 1.0
+	saliencySkinWeight       = 1.8
+	saliencySaturationWeight = 0.3
+
+	// windows further away from the center lose up to this fraction of their score
+	saliencyCenterBias = 0.1
+)
+
+// the skin color as normalized rgb vector
+var saliencySkinColor = [3]float64{0.78, 0.57, 0.44}
+
+//SaliencyResizer scales the image down and crops it to the part with the most content
+//the content is scored by edges, skin tones and saturation, so it works without face detection
+type SaliencyResizer struct {
+}
+
+//Resize with mode saliency. Does the acutal resizing and returns the image
+//errors only if dstWidth or dstHeight is invalid
+func (s SaliencyResizer) Resize(input image.Image, dstWidth, dstHeight int) (image.Image, error) {
+	// if the ratio is kept, there is nothing to crop
+	if dstWidth < 0 || dstHeight < 0 {
+		return CropResizer{}.Resize(input, dstWidth, dstHeight)
+	}
+
+	return imaging.Resize(imaging.Crop(input, s.window(input, dstWidth, dstHeight)), dstWidth, dstHeight, imaging.Lanczos), nil
+}
+
+//window returns the part of the image with the most content in the ratio of dstWidth and dstHeight
+func (s SaliencyResizer) window(input image.Image, dstWidth, dstHeight int) image.Rectangle {
+	bounds := input.Bounds()
+	crop := cropRectangle(bounds, dstWidth, dstHeight, bounds.Min)
+	if crop.Dx() < bounds.Dx() {
+		offset := bestWindow(saliencyProfile(input, true), float64(crop.Dx())/float64(bounds.Dx()))
+		crop = crop.Add(image.Pt(clamp(int(offset*float64(bounds.Dx())), 0, bounds.Dx()-crop.Dx()), 0))
+	} else if crop.Dy() < bounds.Dy() {
+		offset := bestWindow(saliencyProfile(input, false), float64(crop.Dy())/float64(bounds.Dy()))
+		crop = crop.Add(image.Pt(0, clamp(int(offset*float64(bounds.Dy())), 0, bounds.Dy()-crop.Dy())))
+	}
+
+	return crop
+}
+
+//saliencyProfile returns the summed up saliency of every column, or every row if horizontal is false
+//of a downscaled copy of the image
+func saliencyProfile(input image.Image, horizontal bool) []float64 {
+	bounds := input.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width > saliencyAnalysisSize || height > saliencyAnalysisSize {
+		if width > height {
+			width, height = saliencyAnalysisSize, int(math.Max(1, float64(height*saliencyAnalysisSize/width)))
+		} else {
+			width, height = int(math.Max(1, float64(width*saliencyAnalysisSize/height))), saliencyAnalysisSize
+		}
+	}
+
+	analysis := imaging.Resize(input, width, height, imaging.Box)
+	edges, skin, saturation := saliencyMaps(analysis)
+	normalize(edges)
+	normalize(skin)
+	normalize(saturation)
+
+	profile := make([]float64, width)
+	if !horizontal {
+		profile = make([]float64, height)
+	}
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			i := y*width + x
+			score := edges[i]*saliencyEdgeWeight + skin[i]*saliencySkinWeight + saturation[i]*saliencySaturationWeight
+			if horizontal {
+				profile[x] += score
+			} else {
+				profile[y] += score
+			}
+		}
+	}
+
+	return profile
+}
+
+//saliencyMaps scores every pixel by its edges, skin tone and saturation
+func saliencyMaps(img *image.NRGBA) (edges, skin, saturation []float64) {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	luminance := make([]float64, width*height)
+	edges = make([]float64, width*height)
+	skin = make([]float64, width*height)
+	saturation = make([]float64, width*height)
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			pixel := img.Pix[y*img.Stride+x*4:]
+			r, g, b := float64(pixel[0])/255, float64(pixel[1])/255, float64(pixel[2])/255
+			i := y*width + x
+			luminance[i] = 0.2126*r + 0.7152*g + 0.0722*b
+
+			max := math.Max(r, math.Max(g, b))
+			min := math.Min(r, math.Min(g, b))
+			if max > 0 && luminance[i] > 0.05 && luminance[i] < 0.9 {
+				saturation[i] = (max - min) / max
+			}
+
+			length := math.Sqrt(r*r + g*g + b*b)
+			if length > 0 && luminance[i] > 0.2 {
+				dr, dg, db := r/length-saliencySkinColor[0], g/length-saliencySkinColor[1], b/length-saliencySkinColor[2]
+				if distance := math.Sqrt(dr*dr + dg*dg + db*db); distance < 0.2 {
+					skin[i] = 1 - distance/0.2
+				}
+			}
+		}
+	}
+
+	at := func(x, y int) float64 {
+		return luminance[clamp(y, 0, height-1)*width+clamp(x, 0, width-1)]
+	}
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			edges[y*width+x] = math.Abs(4*at(x, y) - at(x-1, y) - at(x+1, y) - at(x, y-1) - at(x, y+1))
+		}
+	}
+
+	return edges, skin, saturation
+}
+
+//normalize scales the values to an average of 1, so all maps are weighted equally
+func normalize(values []float64) {
+	sum := 0.0
+	for _, value := range values {
+		sum += value
+	}
+
+	if sum == 0 {
+		return
+	}
+
+	average := sum / float64(len(values))
+	for i := range values {
+		values[i] /= average
+	}
+}
+
+//bestWindow returns the start of the window with the highest score as fraction of the profile length
+//size is the length of the window as fraction of the profile length
+func bestWindow(profile []float64, size float64) float64 {
+	length := int(size * float64(len(profile)))
+	if length < 1 {
+		length = 1
+	}
+
+	positions := len(profile) - length
+	if positions <= 0 {
+		return 0
+	}
+
+	sum := 0.0
+	for _, value := range profile[:length] {
+		sum += value
+	}
+
+	best, bestScore := positions/2, -1.0
+	for position := 0; position <= positions; position++ {
+		if position > 0 {
+			sum += profile[position+length-1] - profile[position-1]
+		}
+
+		distance := math.Abs(float64(position)-float64(positions)/2) / (float64(positions) / 2)
+		// without any content, the center wins
+		score := (sum + 1) * (1 - saliencyCenterBias*distance)
+		if score > bestScore {
+			best, bestScore = position, score
+		}
+	}
+
+	return float64(best) / float64(len(profile))
+}
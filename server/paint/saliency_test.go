@@ -0,0 +1,106 @@
+package paint_test
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+
+	. "github.com/VoycerAG/gridfs-image-server/server/paint"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Saliency crop", func() {
+	gray := color.NRGBA{R: 128, G: 128, B: 128, A: 255}
+
+	// detailed returns a gray image with a colorful checkerboard within area
+	detailed := func(bounds, area image.Rectangle) image.Image {
+		img := image.NewNRGBA(bounds)
+		draw.Draw(img, bounds, image.NewUniform(gray), image.ZP, draw.Src)
+		for y := area.Min.Y; y < area.Max.Y; y++ {
+			for x := area.Min.X; x < area.Max.X; x++ {
+				if (x/4+y/4)%2 == 0 {
+					img.Set(x, y, color.NRGBA{R: 220, G: 40, B: 40, A: 255})
+				}
+			}
+		}
+
+		return img
+	}
+
+	// details returns the number of pixels that are not gray in the given area
+	details := func(img image.Image, area image.Rectangle) int {
+		result := 0
+		for y := area.Min.Y; y < area.Max.Y; y++ {
+			for x := area.Min.X; x < area.Max.X; x++ {
+				r, g, b, _ := img.At(x, y).RGBA()
+				if r>>8 > 160 || g>>8 < 100 || b>>8 < 100 {
+					result++
+				}
+			}
+		}
+
+		return result
+	}
+
+	It("should crop to the detailed part of wide images", func() {
+		cropped, err := SaliencyResizer{}.Resize(detailed(image.Rect(0, 0, 300, 100), image.Rect(220, 20, 280, 80)), 50, 50)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cropped.Bounds()).To(Equal(image.Rect(0, 0, 50, 50)))
+		// the checkerboard covers 30x30 pixels of the resized image, half of them are red
+		Expect(details(cropped, cropped.Bounds())).To(BeNumerically(">", 300))
+	})
+
+	It("should crop to the detailed part of tall images", func() {
+		cropped, err := SaliencyResizer{}.Resize(detailed(image.Rect(0, 0, 100, 300), image.Rect(20, 200, 80, 260)), 50, 50)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(details(cropped, cropped.Bounds())).To(BeNumerically(">", 300))
+	})
+
+	It("should crop around the center of images without content", func() {
+		cropped, err := SaliencyResizer{}.Resize(detailed(image.Rect(0, 0, 300, 100), image.Rect(140, 0, 160, 100)), 100, 100)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(details(cropped, image.Rect(40, 0, 60, 100))).To(BeNumerically(">", 500))
+		Expect(details(cropped, image.Rect(0, 0, 35, 100))).To(BeZero())
+		Expect(details(cropped, image.Rect(65, 0, 100, 100))).To(BeZero())
+
+		uniform := detailed(image.Rect(0, 0, 300, 100), image.Rectangle{})
+		cropped, err = SaliencyResizer{}.Resize(uniform, 100, 100)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cropped.Bounds()).To(Equal(image.Rect(0, 0, 100, 100)))
+	})
+
+	It("should crop every frame of animations to the same window", func() {
+		// the details move from the right to the left side
+		animated := &gif.GIF{}
+		for _, area := range []image.Rectangle{image.Rect(220, 20, 280, 80), image.Rect(20, 20, 80, 80)} {
+			frame := image.NewPaletted(image.Rect(0, 0, 300, 100), color.Palette{gray, color.NRGBA{R: 220, G: 40, B: 40, A: 255}})
+			draw.Draw(frame, frame.Bounds(), detailed(frame.Bounds(), area), image.ZP, draw.Src)
+			animated.Image = append(animated.Image, frame)
+			animated.Delay = append(animated.Delay, 10)
+		}
+
+		var buffer bytes.Buffer
+		Expect(gif.EncodeAll(&buffer, animated)).To(Succeed())
+		controller, err := NewController(&buffer, map[ResizeType]Resizer{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(controller.Resize(TypeSaliency, 50, 50)).To(Succeed())
+
+		buffer.Reset()
+		Expect(controller.Encode(&buffer)).To(Succeed())
+		resized, err := gif.DecodeAll(&buffer)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(resized.Image).To(HaveLen(2))
+		Expect(details(resized.Image[0], resized.Image[0].Bounds())).To(BeNumerically(">", 100))
+		Expect(details(resized.Image[1], resized.Image[1].Bounds())).To(BeZero())
+	})
+
+	It("should keep the ratio if width or height is not given", func() {
+		resized, err := SaliencyResizer{}.Resize(detailed(image.Rect(0, 0, 300, 100), image.Rect(0, 0, 10, 10)), 150, -1)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(resized.Bounds()).To(Equal(image.Rect(0, 0, 150, 50)))
+	})
+})
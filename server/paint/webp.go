@@ -0,0 +1,18 @@
+// +build webp,cgo
+
+package paint
+
+import (
+	"image"
+	"io"
+
+	"github.com/chai2010/webp"
+)
+
+//webpEncoding is true, because libwebp is available with the build tag webp
+const webpEncoding = true
+
+//encodeWebp encodes img with libwebp
+func encodeWebp(target io.Writer, img image.Image, options EncodeOptions) error {
+	return webp.Encode(target, img, &webp.Options{Lossless: options.Lossless, Quality: float32(options.Quality)})
+}
@@ -0,0 +1,17 @@
+// +build !webp !cgo
+
+package paint
+
+import (
+	"errors"
+	"image"
+	"io"
+)
+
+//webpEncoding is false, because libwebp is only used with the build tag webp
+const webpEncoding = false
+
+//encodeWebp is not available, because libwebp requires cgo and the build tag webp
+func encodeWebp(target io.Writer, img image.Image, options EncodeOptions) error {
+	return errors.New("webp encoding requires cgo and the build tag webp")
+}
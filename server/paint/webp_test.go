@@ -0,0 +1,51 @@
+// +build webp,cgo
+
+package paint_test
+
+import (
+	"bytes"
+	"image"
+	"os"
+
+	"golang.org/x/image/webp"
+
+	. "github.com/VoycerAG/gridfs-image-server/server/paint"
+
+	. "github.com/sharpner/matcher"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Webp encoding", func() {
+	var controller Controller
+
+	BeforeEach(func() {
+		testFile, err := os.Open("../testdata/image.jpg")
+		Expect(err).ToNot(HaveOccurred())
+		defer testFile.Close()
+		controller, err = NewController(testFile, map[ResizeType]Resizer{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(controller.Resize(TypeResize, 20, 10)).To(Succeed())
+	})
+
+	It("should encode lossy webp images", func() {
+		var low, high bytes.Buffer
+		Expect(controller.EncodeWithOptions(&low, EncodeOptions{Format: "webp", Quality: 10})).To(Succeed())
+		Expect(controller.EncodeWithOptions(&high, EncodeOptions{Format: "webp", Quality: 95})).To(Succeed())
+		Expect(low.Len()).To(BeNumerically("<", high.Len()))
+
+		actual, err := webp.Decode(&low)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(actual.Bounds()).To(Equal(image.Rect(0, 0, 20, 10)))
+	})
+
+	It("should encode lossless webp images", func() {
+		var buffer bytes.Buffer
+		Expect(controller.EncodeWithOptions(&buffer, EncodeOptions{Format: "webp", Lossless: true})).To(Succeed())
+
+		actual, err := webp.Decode(&buffer)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(actual).To(EqualImage(controller.Image()))
+	})
+})
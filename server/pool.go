@@ -0,0 +1,119 @@
+package server
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errPoolSaturated = errors.New("image processing pool is saturated")
+)
+
+//PoolStats contains the current state of the processing pool
+type PoolStats struct {
+	MaxConcurrent int    `json:"maxConcurrent"`
+	QueueDepth    int    `json:"queueDepth"`
+	Active        int64  `json:"active"`
+	Queued        int64  `json:"queued"`
+	Processed     uint64 `json:"processed"`
+	Rejected      uint64 `json:"rejected"`
+	TimedOut      uint64 `json:"timedOut"`
+}
+
+//processingPool limits the number of images that are decoded and resized at the same time.
+//If all workers are busy, up to QueueDepth requests will wait for QueueTimeout, all others will be rejected
+type processingPool struct {
+	// counters are accessed atomically and must stay 64 bit aligned
+	active    int64
+	queued    int64
+	processed uint64
+	rejected  uint64
+	timedOut  uint64
+
+	slots   chan struct{}
+	queue   chan struct{}
+	timeout time.Duration
+}
+
+//newProcessingPool uses the defaults for limits that are not set, e.g. if the config has been built in code
+func newProcessingPool(config ProcessingConfig) *processingPool {
+	config = config.withDefaults()
+	return &processingPool{
+		slots:   make(chan struct{}, config.MaxConcurrent),
+		queue:   make(chan struct{}, config.QueueDepth),
+		timeout: time.Duration(config.QueueTimeout) * time.Millisecond,
+	}
+}
+
+//run executes process as soon as a worker is free.
+//errPoolSaturated will be returned if the queue is full or the queue timeout elapsed
+func (p *processingPool) run(process func()) error {
+	select {
+	case p.slots <- struct{}{}:
+	default:
+		if err := p.wait(); err != nil {
+			return err
+		}
+	}
+
+	atomic.AddInt64(&p.active, 1)
+	defer func() {
+		atomic.AddInt64(&p.active, -1)
+		atomic.AddUint64(&p.processed, 1)
+		<-p.slots
+	}()
+
+	process()
+	return nil
+}
+
+//wait queues the caller until a worker is free
+func (p *processingPool) wait() error {
+	select {
+	case p.queue <- struct{}{}:
+	default:
+		atomic.AddUint64(&p.rejected, 1)
+		return errPoolSaturated
+	}
+
+	atomic.AddInt64(&p.queued, 1)
+	defer func() {
+		atomic.AddInt64(&p.queued, -1)
+		<-p.queue
+	}()
+
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
+
+	select {
+	case p.slots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		atomic.AddUint64(&p.timedOut, 1)
+		return errPoolSaturated
+	}
+}
+
+//retryAfter returns the number of seconds clients should wait before retrying
+func (p *processingPool) retryAfter() int {
+	seconds := int((p.timeout + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		return 1
+	}
+
+	return seconds
+}
+
+//stats returns a snapshot of the pool statistics
+func (p *processingPool) stats() PoolStats {
+	return PoolStats{
+		MaxConcurrent: cap(p.slots),
+		QueueDepth:    cap(p.queue),
+		Active:        atomic.LoadInt64(&p.active),
+		Queued:        atomic.LoadInt64(&p.queued),
+		Processed:     atomic.LoadUint64(&p.processed),
+		Rejected:      atomic.LoadUint64(&p.rejected),
+		TimedOut:      atomic.LoadUint64(&p.timedOut),
+	}
+}
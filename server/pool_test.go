@@ -0,0 +1,139 @@
+package server_test
+
+import (
+	"encoding/json"
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+
+	. "github.com/VoycerAG/gridfs-image-server/server"
+	"github.com/VoycerAG/gridfs-image-server/server/paint"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const (
+	poolConfig = `
+{
+	"processing" : {
+		"maxConcurrent" : 1,
+		"queueDepth" : 1,
+		"queueTimeout" : 200
+	},
+	"allowedEntries" : [
+		{
+			"name" : "blocking",
+			"width" : 45,
+			"height" : 35,
+			"type" : "blocking"
+		}
+	]
+}
+	`
+)
+
+//blockingResizer will not return until release is closed
+type blockingResizer struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b blockingResizer) Resize(input image.Image, dstWidth, dstHeight int) (image.Image, error) {
+	b.started <- struct{}{}
+	<-b.release
+	return input, nil
+}
+
+var _ = Describe("Processing pool", func() {
+	var (
+		resizer     blockingResizer
+		imageServer Server
+	)
+
+	serve := func(url string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", url, nil)
+		Expect(err).ToNot(HaveOccurred())
+		rec := httptest.NewRecorder()
+		imageServer.Handler().ServeHTTP(rec, req)
+		return rec
+	}
+
+	stats := func() PoolStats {
+		result := PoolStats{}
+		rec := serve("/stats")
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(json.Unmarshal(rec.Body.Bytes(), &result)).To(Succeed())
+		return result
+	}
+
+	BeforeEach(func() {
+		resizer = blockingResizer{started: make(chan struct{}, 10), release: make(chan struct{})}
+		paint.AddResizer("blocking", resizer)
+
+		config, err := NewConfigFromBytes([]byte(poolConfig))
+		Expect(err).ToNot(HaveOccurred())
+		storage := NewMemoryStorage()
+		for _, filename := range []string{"first.jpg", "second.jpg", "third.jpg"} {
+			_, err = storage.AddImageFromFile("testdb", filename, "./testdata/image.jpg", nil)
+			Expect(err).ToNot(HaveOccurred())
+		}
+
+		imageServer = NewImageServer(config, storage)
+	})
+
+	AfterEach(func() {
+		paint.RemoveResizer("blocking")
+	})
+
+	It("will queue, time out and reject requests if all workers are busy", func() {
+		first := make(chan int)
+		go func() {
+			defer GinkgoRecover()
+			first <- serve("/testdb/first.jpg?size=blocking").Code
+		}()
+		Eventually(resizer.started).Should(Receive())
+
+		second := make(chan *httptest.ResponseRecorder)
+		go func() {
+			defer GinkgoRecover()
+			second <- serve("/testdb/second.jpg?size=blocking")
+		}()
+		Eventually(func() int64 { return stats().Queued }).Should(Equal(int64(1)))
+
+		rec := serve("/testdb/third.jpg?size=blocking")
+		Expect(rec.Code).To(Equal(http.StatusServiceUnavailable))
+		Expect(rec.Header().Get("Retry-After")).To(Equal("1"))
+
+		rec = <-second
+		Expect(rec.Code).To(Equal(http.StatusServiceUnavailable))
+		Expect(rec.Header().Get("Retry-After")).To(Equal("1"))
+
+		current := stats()
+		Expect(current.MaxConcurrent).To(Equal(1))
+		Expect(current.Active).To(Equal(int64(1)))
+		Expect(current.Queued).To(Equal(int64(0)))
+		Expect(current.Rejected).To(Equal(uint64(1)))
+		Expect(current.TimedOut).To(Equal(uint64(1)))
+
+		close(resizer.release)
+		Expect(<-first).To(Equal(http.StatusOK))
+		Expect(stats().Processed).To(Equal(uint64(1)))
+		Expect(stats().Active).To(Equal(int64(0)))
+	})
+
+	It("will use the defaults if the config has been built in code", func() {
+		storage := NewMemoryStorage()
+		_, err := storage.AddImageFromFile("testdb", "first.jpg", "./testdata/image.jpg", nil)
+		Expect(err).ToNot(HaveOccurred())
+		imageServer = NewImageServer(&Config{
+			AllowedEntries: []Entry{{Name: "small", Width: 45, Height: 35, Type: paint.TypeResize}},
+		}, storage)
+
+		Expect(serve("/testdb/first.jpg?size=small").Code).To(Equal(http.StatusOK))
+		current := stats()
+		Expect(current.MaxConcurrent).To(Equal(runtime.NumCPU()))
+		Expect(current.QueueDepth).To(Equal(DefaultQueueDepth))
+	})
+})
@@ -1,11 +1,15 @@
 package resizer
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"image"
+	"io"
 	"log"
 	"os"
+	"runtime"
+	"sync"
 
 	"github.com/VoycerAG/gridfs-image-server/server/paint"
 	"github.com/disintegration/imaging"
@@ -16,22 +20,37 @@ import (
 const (
 	//TypeSmartcrop will use magic to find the center of attention
 	TypeSmartcrop paint.ResizeType = "smartcrop"
-	//how much of the original image must be "face"
+	//how much of the original image must be covered by a face, smaller faces are ignored
 	faceImageTreshold = 0.10
+	//the fraction of the size of all faces, that is added on every side
+	facePadding = 0.25
+	//the maximum width or height of images during the face detection
+	detectionSize = 1024
 )
 
 var (
 	//ErrNoFacesFound this error will be produced if no face could be found in the image
 	ErrNoFacesFound = errors.New("No faces found")
+	//ErrClosed will be produced if the resizer has already been closed
+	ErrClosed = errors.New("Smartcrop has been closed")
 )
 
-type subImager interface {
-	SubImage(r image.Rectangle) image.Image
+//Smartcrop is a resizer that holds a haar cascade until it is closed
+//the detection can be configured with paint.FaceOptions
+type Smartcrop interface {
+	paint.OptionsResizer
+	paint.FaceDetector
+	io.Closer
 }
 
 type smartcropResizer struct {
-	haarcascade     string
 	fallbackResizer paint.Resizer
+
+	// a cascade is not safe for concurrent use, so every detection takes one of the pool
+	cascades chan *opencv.HaarCascade
+	// running detections hold the read lock, closing waits until all of them are finished
+	lock   sync.RWMutex
+	closed bool
 }
 
 var nilFallbackResizer paint.Resizer
@@ -53,90 +72,183 @@ func normalizeInput(input image.Image, maxSize int) (image.Image, float64, error
 //NewSmartcrop returns a new resizer for the `TypeSmartcrop`
 //it needs opencv internally so this resizer
 //Warning: will not allow cross compilation
-func NewSmartcrop(haarcascade string, fallbackResizer paint.Resizer) paint.Resizer {
-	return &smartcropResizer{haarcascade: haarcascade, fallbackResizer: fallbackResizer}
+//The haarcascade is loaded once per cpu, so faces of multiple images can be detected concurrently.
+//Close must be called to release them
+func NewSmartcrop(haarcascade string, fallbackResizer paint.Resizer) (Smartcrop, error) {
+	if err := validateHaarcascade(haarcascade); err != nil {
+		return nil, err
+	}
+
+	cascades := make(chan *opencv.HaarCascade, runtime.NumCPU())
+	for i := 0; i < cap(cascades); i++ {
+		cascades <- opencv.LoadHaarClassifierCascade(haarcascade)
+	}
+
+	return &smartcropResizer{
+		fallbackResizer: fallbackResizer,
+		cascades:        cascades,
+	}, nil
 }
 
-//Resize will try to resize via face detection, if no face got found, it will use the fallback resizer
-func (s smartcropResizer) Resize(input image.Image, dstWidth, dstHeight int) (image.Image, error) {
-	res, err := s.smartResize(input, dstWidth, dstHeight)
+//validateHaarcascade checks that the file is an opencv storage,
+//because opencv can not report invalid files
+func validateHaarcascade(haarcascade string) error {
+	file, err := os.Open(haarcascade)
 	if err != nil {
-		log.Printf("Using fallback resizer because %s.", err.Error())
-		return s.fallbackResizer.Resize(input, dstWidth, dstHeight)
+		return err
 	}
+	defer file.Close()
 
-	log.Println("Using face resizer.")
-	return res, err
+	// cascades start with a license comment, so the storage tag is searched within the first kilobytes
+	header := make([]byte, 64<<10)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return fmt.Errorf("invalid haarcascade %s: %s", haarcascade, err.Error())
+	}
+
+	if !bytes.Contains(header[:n], []byte("<opencv_storage>")) && !bytes.HasPrefix(header[:n], []byte("%YAML")) {
+		return fmt.Errorf("invalid haarcascade %s: not an opencv storage", haarcascade)
+	}
+
+	return nil
 }
 
-func (s smartcropResizer) smartResize(input image.Image, dstWidth, dstHeight int) (image.Image, error) {
-	if dstWidth < 0 || dstHeight < 0 {
-		return nil, fmt.Errorf("Please specify both width and height for your target image")
+//Close releases the haarcascades, all following resizes will use the fallback resizer
+func (s *smartcropResizer) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return nil
 	}
 
-	scaledInput, scale, err := normalizeInput(input, 1024)
-	if err != nil {
-		return input, err
+	// no detection is running, so all cascades have been returned to the pool
+	for i := 0; i < cap(s.cascades); i++ {
+		(<-s.cascades).Release()
+	}
+	s.closed = true
+
+	return nil
+}
+
+//detectFaces returns all faces of the image
+func (s *smartcropResizer) detectFaces(input image.Image) ([]*opencv.Rect, error) {
+	cvImage := opencv.FromImage(input)
+	defer cvImage.Release()
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.closed {
+		return nil, ErrClosed
 	}
 
-	cvImage := opencv.FromImage(scaledInput)
-	_, err = os.Stat(s.haarcascade)
+	cascade := <-s.cascades
+	defer func() { s.cascades <- cascade }()
+
+	return cascade.DetectObjects(cvImage), nil
+}
+
+//Resize will try to resize via face detection, if no face got found, it will use the fallback resizer
+func (s *smartcropResizer) Resize(input image.Image, dstWidth, dstHeight int) (image.Image, error) {
+	return s.ResizeWithOptions(input, dstWidth, dstHeight, paint.ResizeOptions{})
+}
+
+//ResizeWithOptions uses the face options instead of the defaults,
+//all options are passed to the fallback resizer
+func (s *smartcropResizer) ResizeWithOptions(input image.Image, dstWidth, dstHeight int, options paint.ResizeOptions) (image.Image, error) {
+	res, err := s.smartResize(input, dstWidth, dstHeight, options.Faces)
 	if err != nil {
-		return input, err
+		log.Printf("Using fallback resizer because %s.", err.Error())
+		return paint.ResizeWithOptions(s.fallback(options.Faces), input, dstWidth, dstHeight, options)
 	}
 
-	cascade := opencv.LoadHaarClassifierCascade(s.haarcascade)
-	faces := cascade.DetectObjects(cvImage)
+	log.Println("Using face resizer.")
+	return res, err
+}
 
-	if len(faces) == 0 {
-		return nil, ErrNoFacesFound
+//fallback returns the fallback resizer of the options, or the default one
+func (s *smartcropResizer) fallback(options paint.FaceOptions) paint.Resizer {
+	// the smartcrop itself would never stop falling back
+	if options.Fallback == "" || options.Fallback == TypeSmartcrop {
+		return s.fallbackResizer
 	}
 
-	var biggestFace *opencv.Rect
+	return paint.NewResizer(options.Fallback)
+}
 
-	for _, f := range faces {
-		if biggestFace == nil {
-			biggestFace = f
-			continue
-		}
+//DetectFaces returns all faces of the image in its coordinates, regardless of their size
+func (s *smartcropResizer) DetectFaces(input image.Image, options paint.FaceOptions) ([]image.Rectangle, error) {
+	maxSize := detectionSize
+	if options.DetectionSize > 0 {
+		maxSize = options.DetectionSize
+	}
 
-		biggestArea := biggestFace.Width() * biggestFace.Height()
-		currentArea := f.Width() * f.Height()
-		if biggestArea < currentArea {
-			biggestFace = f
-		}
+	scaledInput, scale, err := normalizeInput(input, maxSize)
+	if err != nil {
+		return nil, err
+	}
+
+	faces, err := s.detectFaces(scaledInput)
+	if err != nil {
+		return nil, err
 	}
 
 	log.Printf("Faces found %d\n", len(faces))
 
-	if biggestFace == nil {
-		return nil, ErrNoFacesFound
+	// faces are detected in the scaled image, but cropped from the original
+	bounds := input.Bounds()
+	result := make([]image.Rectangle, 0, len(faces))
+	for _, f := range faces {
+		face := image.Rect(
+			int(float64(f.X())*scale),
+			int(float64(f.Y())*scale),
+			int(float64(f.X()+f.Width())*scale),
+			int(float64(f.Y()+f.Height())*scale),
+		).Add(bounds.Min)
+		result = append(result, face)
 	}
 
-	faceArea := biggestFace.Width() * biggestFace.Height()
-	imagePixels := scaledInput.Bounds().Dx() * scaledInput.Bounds().Dy()
+	return result, nil
+}
 
-	faceAreaPercentage := float64(faceArea) / float64(imagePixels)
-	if faceAreaPercentage < faceImageTreshold {
-		return nil, fmt.Errorf("face area too small: %.2f.\n", faceAreaPercentage)
+func (s *smartcropResizer) smartResize(input image.Image, dstWidth, dstHeight int, options paint.FaceOptions) (image.Image, error) {
+	if dstWidth < 0 || dstHeight < 0 {
+		return nil, fmt.Errorf("Please specify both width and height for your target image")
 	}
 
-	if sub, ok := input.(subImager); ok {
-		x := int(float64(biggestFace.X()) * scale)
-		y := int(float64(biggestFace.Y()) * scale)
-		width := int(float64(biggestFace.Width()) * scale)
-		height := int(float64(biggestFace.Height()) * scale)
+	// faces might have been detected before, e.g. for another size of the same image
+	faces := options.Detected
+	if faces == nil {
+		var err error
+		faces, err = s.DetectFaces(input, options)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-		facePoint := image.Pt(x, y)
-		target := image.Rect(0, 0, int(float64(dstWidth)*scale), int(float64(dstHeight)*scale))
-		r := image.Rect(0, 0, x+width, y+height).Add(facePoint)
-		for !target.In(r) && r.Min.X > 0 && r.Min.Y > 0 {
-			r = image.Rect(r.Min.X-1, r.Min.Y-1, r.Max.X+1, r.Max.Y+1)
+	bounds := input.Bounds()
+	minArea := faceImageTreshold
+	if options.MinArea > 0 {
+		minArea = options.MinArea
+	}
+	minArea *= float64(bounds.Dx() * bounds.Dy())
+	frame := []image.Rectangle{}
+	for _, face := range faces {
+		if float64(face.Dx()*face.Dy()) >= minArea {
+			frame = append(frame, face)
 		}
+	}
+
+	if len(frame) == 0 {
+		return nil, ErrNoFacesFound
+	}
 
-		cropImage := sub.SubImage(r)
-		return imaging.Thumbnail(cropImage, dstWidth, dstHeight, imaging.Lanczos), nil
+	padding := facePadding
+	if options.Padding != nil {
+		padding = *options.Padding
 	}
 
-	return input, err
+	crop := paint.FrameFaces(bounds, frame, dstWidth, dstHeight, padding)
+	return imaging.Resize(imaging.Crop(input, crop), dstWidth, dstHeight, imaging.Lanczos), nil
 }
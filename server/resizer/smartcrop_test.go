@@ -3,6 +3,7 @@ package resizer_test
 import (
 	"fmt"
 	"image"
+	"image/color"
 	"log"
 	"os"
 	"path/filepath"
@@ -76,16 +77,76 @@ var _ = Describe("Smartcrop testsuite", func() {
 		{Width: 50, Height: 50},
 	}
 
+	It("will only load valid haarcascades", func() {
+		_, err := NewSmartcrop("./does-not-exist.xml", paint.CropResizer{})
+		Expect(err).To(HaveOccurred())
+
+		_, err = NewSmartcrop(inputFolder+".gitkeep", paint.CropResizer{})
+		Expect(err).To(HaveOccurred())
+
+		resizer, err := NewSmartcrop(haarCascade, paint.CropResizer{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(resizer.Close()).To(Succeed())
+	})
+
+	It("will use the fallback resizer after closing", func() {
+		resizer, err := NewSmartcrop(haarCascade, paint.CropResizer{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(resizer.Close()).To(Succeed())
+		Expect(resizer.Close()).To(Succeed())
+
+		output, err := resizer.Resize(image.NewRGBA(image.Rect(0, 0, 200, 100)), 50, 50)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(output.Bounds()).To(Equal(image.Rect(0, 0, 50, 50)))
+	})
+
+	It("will use the fallback resizer of the options", func() {
+		resizer, err := NewSmartcrop(haarCascade, paint.CropResizer{})
+		Expect(err).ToNot(HaveOccurred())
+		defer resizer.Close()
+
+		white := color.NRGBA{R: 255, G: 255, B: 255, A: 255}
+		options := paint.ResizeOptions{Background: white, Faces: paint.FaceOptions{Fallback: paint.TypePad, DetectionSize: 64}}
+		output, err := resizer.ResizeWithOptions(image.NewRGBA(image.Rect(0, 0, 200, 100)), 50, 50, options)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(output.Bounds()).To(Equal(image.Rect(0, 0, 50, 50)))
+		Expect(output.At(25, 2)).To(Equal(white))
+	})
+
+	It("will crop around the detected faces of the options without the haarcascade", func() {
+		resizer, err := NewSmartcrop(haarCascade, paint.CropResizer{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(resizer.Close()).To(Succeed())
+
+		red := color.NRGBA{R: 255, A: 255}
+		input := image.NewNRGBA(image.Rect(0, 0, 200, 100))
+		for y := 0; y < 100; y++ {
+			for x := 0; x < 50; x++ {
+				input.Set(x, y, red)
+			}
+		}
+
+		// the face covers more than 10% of the image, smaller faces would be ignored
+		padding := 0.0
+		options := paint.ResizeOptions{Faces: paint.FaceOptions{Detected: []image.Rectangle{image.Rect(4, 30, 46, 80)}, Padding: &padding}}
+		output, err := resizer.ResizeWithOptions(input, 50, 50, options)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(output.Bounds()).To(Equal(image.Rect(0, 0, 50, 50)))
+		Expect(output.At(45, 25)).To(Equal(red))
+	})
+
 	Measure("it will generate multiple face detected images", func(b Benchmarker) {
 		b.Time("runtime", func() {
-			resizer := NewSmartcrop(haarCascade, paint.CropResizer{})
+			resizer, err := NewSmartcrop(haarCascade, paint.CropResizer{})
+			Expect(err).ToNot(HaveOccurred())
+			defer resizer.Close()
 			facesFound := 0
 			noFacesFound := 0
 			errors := 0
 			var f format
 			f, formats = formats[len(formats)-1], formats[:len(formats)-1]
 
-			err := filepath.Walk(inputFolder, func(path string, fi os.FileInfo, err error) error {
+			err = filepath.Walk(inputFolder, func(path string, fi os.FileInfo, err error) error {
 				if fi != nil && fi.IsDir() || filepath.Base(path) == ".gitkeep" {
 					return nil
 				}
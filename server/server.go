@@ -3,10 +3,15 @@ package server
 import (
 	"bufio"
 	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"image"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"strconv"
 
 	"github.com/VoycerAG/gridfs-image-server/server/paint"
 	"github.com/gorilla/context"
@@ -17,6 +22,12 @@ import (
 const (
 	//ImageCacheDuration caching time for images
 	ImageCacheDuration = 315360000
+	//statusUnprocessableEntity is returned for images that exceed the configured limits
+	statusUnprocessableEntity = 422
+)
+
+var (
+	errOutdated = errors.New("resized image is outdated")
 )
 
 type imageServer struct {
@@ -42,11 +53,50 @@ func NewImageServerWithNewRelic(config *Config, storage Storage, licenseKey stri
 	// in order to simple configure the image server in the proxy configuration of nginx
 	// we will be getting every database variable from the request
 	serverRoute := "/{database}/{filename}"
+	// images can also be requested from a specific bucket of the database
+	bucketRoute := "/{database}/{bucket}/{filename}"
+
+	// decoding and resizing of images is limited by the processing pool
+	pool := newProcessingPool(config.Processing)
 
 	r := mux.NewRouter()
 	r.HandleFunc("/", welcomeHandler)
+	r.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		statsHandler(w, r, pool)
+	}).Methods("GET")
+
+	// write access is only possible with a configured auth token
+	// those routes must be registered first, so they take precedence
+	if config.AuthToken != "" {
+		uploadRequestHandler := func(w http.ResponseWriter, r *http.Request) {
+			uploadHandler(w, r, storage, *config, pool)
+		}
+
+		r.HandleFunc("/{database}", uploadRequestHandler).Methods("POST")
+		r.HandleFunc("/{database}/{bucket}", uploadRequestHandler).Methods("POST")
+		r.HandleFunc(serverRoute, uploadRequestHandler).Methods("PUT")
+		r.HandleFunc(bucketRoute, uploadRequestHandler).Methods("PUT")
+
+		deleteRequestHandler := func(w http.ResponseWriter, r *http.Request) {
+			deleteHandler(w, r, storage, *config)
+		}
+
+		r.HandleFunc(serverRoute, deleteRequestHandler).Methods("DELETE")
+		r.HandleFunc(bucketRoute, deleteRequestHandler).Methods("DELETE")
+	}
+
+	// the faces routes must be registered before the image routes, so they take precedence.
+	// a GET on /{database}/{filename}/faces returns the faces of filename, even if a bucket
+	// named like filename contains an image named faces
+	facesRequestHandler := func(w http.ResponseWriter, r *http.Request) {
+		facesHandler(w, r, storage, pool, config.Limits)
+	}
+	r.HandleFunc(serverRoute+"/faces", facesRequestHandler).Methods("GET")
+	r.HandleFunc(bucketRoute+"/faces", facesRequestHandler).Methods("GET")
+
 	//TODO refactor depedency mess
-	r.Handle(serverRoute, func(storage Storage, z *Config) http.HandlerFunc {
+	resizes := newResizeGroup()
+	imageRequestHandler := func(storage Storage, z *Config) http.HandlerFunc {
 		return func(w http.ResponseWriter, r *http.Request) {
 			vars := mux.Vars(r)
 
@@ -58,12 +108,13 @@ func NewImageServerWithNewRelic(config *Config, storage Storage, licenseKey stri
 				return
 			}
 
-			imageHandler(w, r, *requestConfig, storage, *z)
+			imageHandler(w, r, *requestConfig, storage, *z, resizes, pool)
 		}
-	}(storage, config))
-	http.Handle("/", r)
+	}(storage, config)
+	r.Handle(serverRoute, imageRequestHandler)
+	r.Handle(bucketRoute, imageRequestHandler)
 
-	handler = http.DefaultServeMux
+	handler = r
 
 	if licenseKey != "" {
 		agent := gorelic.NewAgent()
@@ -89,18 +140,23 @@ func imageHandler(
 	requestConfig Configuration,
 	storage Storage,
 	imageConfig Config,
+	resizes *resizeGroup,
+	pool *processingPool,
 ) {
 	log.Printf("Request on %s", r.URL)
 
 	respondWithImage := func(w http.ResponseWriter, r *http.Request, img Cacheable, data io.ReadSeeker) {
 		w.Header().Set("Etag", img.CacheIdentifier())
 		http.ServeContent(w, r, "", img.LastModified(), data)
+		if closer, ok := data.(io.Closer); ok {
+			closer.Close()
+		}
 		log.Printf("%d Responding with image.\n", http.StatusOK)
 	}
 
 	resizeEntry, err := imageConfig.GetEntryByName(requestConfig.FormatName)
 	if err != nil { // no valid resize configuration in request
-		img, notFoundErr := getOriginalImage(requestConfig.Filename, requestConfig.Database, storage)
+		img, notFoundErr := getOriginalImage(requestConfig.Filename, requestConfig.Namespace(), storage)
 
 		if notFoundErr != nil {
 			log.Printf("%d file not found.\n", http.StatusNotFound)
@@ -113,10 +169,31 @@ func imageHandler(
 		return
 	}
 
-	img, notFoundErr := getResizeImage(*resizeEntry, requestConfig.Filename, requestConfig.Database, storage)
+	if imageConfig.AcceptNegotiation {
+		// the response depends on the accept header, even if the format did not change
+		w.Header().Add("Vary", "Accept")
+		resizeEntry = negotiateFormat(r, resizeEntry)
+	}
+
+	img, notFoundErr := getResizeImage(*resizeEntry, requestConfig.Filename, requestConfig.Namespace(), storage)
+
+	var original Cacheable
+	if notFoundErr == nil {
+		// the original might have been replaced after the resized image was created
+		original, err = getOriginalImage(requestConfig.Filename, requestConfig.Namespace(), storage)
+		if err == nil && isOutdated(img, original, resizeEntry) {
+			log.Printf("Resized image of %s is outdated.\n", requestConfig.Filename)
+			img.Data().Close()
+			notFoundErr = errOutdated
+		} else if err == nil {
+			original.Data().Close()
+		}
+	}
 
 	if notFoundErr != nil {
-		img, err := getOriginalImage(requestConfig.Filename, requestConfig.Database, storage)
+		if original == nil {
+			original, err = getOriginalImage(requestConfig.Filename, requestConfig.Namespace(), storage)
+		}
 
 		if err != nil {
 			log.Printf("%d original file not found.\n", http.StatusNotFound)
@@ -124,51 +201,194 @@ func imageHandler(
 			return
 		}
 
+		// concurrent requests for the same size of the same original will share a single resize
+		key := fmt.Sprintf("%s/%s/%s/%s", requestConfig.Namespace(), original.Name(), original.CacheIdentifier(), resizeEntry.childKey())
+		result, shared := resizes.do(key, func() resizeResult {
+			return resizeImage(original, resizeEntry, requestConfig.Namespace(), storage, pool, imageConfig.Limits)
+		})
+		original.Data().Close()
+
+		if result.err != nil {
+			log.Printf("%d image could not be resized. Reason: [%s].\n", result.status, result.err.Error())
+			if result.status == http.StatusServiceUnavailable {
+				w.Header().Set("Retry-After", strconv.Itoa(pool.retryAfter()))
+			}
+			w.WriteHeader(result.status)
+			return
+		}
+
+		respondWithImage(w, r, result.image, bytes.NewReader(result.data))
+		if shared {
+			log.Printf("%d image resized by a concurrent request and returned.\n", http.StatusOK)
+		} else {
+			log.Printf("%d image succesfully resized and returned.\n", http.StatusOK)
+		}
+
+		return
+	}
+
+	respondWithImage(w, r, img, img.Data())
+}
+
+//resizeImage creates and stores the resized image of original. Decoding and resizing is done by the processing pool.
+//If a concurrent request already stored an up to date resized image, it will be returned instead
+func resizeImage(original Cacheable, entry *Entry, namespace string, storage Storage, pool *processingPool, limits paint.Limits) resizeResult {
+	if child, err := getResizeImage(*entry, original.Name(), namespace, storage); err == nil {
+		childData := child.Data()
+		if isOutdated(child, original, entry) {
+			childData.Close()
+		} else {
+			data, err := ioutil.ReadAll(childData)
+			childData.Close()
+			if err == nil {
+				return resizeResult{image: child, data: data}
+			}
+		}
+	}
+
+	var controller paint.Controller
+	var data []byte
+	var format string
+	var result *resizeResult
+	poolErr := pool.run(func() {
 		customResizers := paint.GetCustomResizers()
-		controller, err := paint.NewController(img.Data(), customResizers)
+		var err error
+		controller, err = paint.NewControllerWithLimits(original.Data(), customResizers, limits)
+		if _, tooLarge := err.(paint.ImageTooLargeError); tooLarge {
+			result = &resizeResult{status: statusUnprocessableEntity, err: err}
+			return
+		}
 
 		if err != nil {
-			log.Printf("%d image could not be decoded. Reason: [%s].\n", http.StatusNotFound, err.Error())
-			w.WriteHeader(http.StatusNotFound)
+			result = &resizeResult{status: http.StatusNotFound, err: err}
 			return
 		}
 
-		err = controller.Resize(resizeEntry.Type, int(resizeEntry.Width), int(resizeEntry.Height))
+		if entry.Flatten {
+			controller.Flatten()
+		}
+
+		if entry.AutoOrient {
+			controller.AutoOrient()
+		}
+
+		options := entry.resizeOptions(outputFormat(entry, controller))
+		if metaContainer, ok := original.(MetaContainer); ok {
+			options.Meta = metaContainer.Meta()
+		}
+
+		// faces of the original are only detected once for all sizes,
+		// they can not be reused if the image has been rotated
+		detector, detectsFaces := paint.NewResizer(entry.Type).(paint.FaceDetector)
+		if detectsFaces && !entry.AutoOrient {
+			faces, err := originalFaces(original, namespace, storage, controller.Image(), detector, options.Faces)
+			if err != nil {
+				log.Printf("Faces of %s could not be detected. Reason: [%s].\n", original.Name(), err.Error())
+			}
+			options.Faces.Detected = faces
+		}
+
+		err = controller.ResizeWithOptions(entry.Type, int(entry.Width), int(entry.Height), options)
 		if err != nil {
-			log.Printf("%d image could not be resized.\n", http.StatusNotFound)
-			w.WriteHeader(http.StatusNotFound)
+			result = &resizeResult{status: http.StatusNotFound, err: err}
 			return
 		}
 
+		format = outputFormat(entry, controller)
 		var b bytes.Buffer
 		buffer := bufio.NewWriter(&b)
-		controller.Encode(buffer)
+		if err := controller.EncodeWithOptions(buffer, entry.encodeOptions(format)); err != nil {
+			result = &resizeResult{status: http.StatusInternalServerError, err: err}
+			return
+		}
 		buffer.Flush()
-		data := b.Bytes()
-
-		targetfile, err := storage.StoreChildImage(
-			requestConfig.Database,
-			controller.Format(),
-			bytes.NewReader(data),
-			controller.Image().Bounds().Dx(),
-			controller.Image().Bounds().Dy(),
-			img,
-			resizeEntry,
-		)
+		data = b.Bytes()
+	})
 
-		if err != nil {
-			log.Printf("%d error %s\n", http.StatusInternalServerError, err.Error())
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+	if poolErr != nil {
+		return resizeResult{status: http.StatusServiceUnavailable, err: poolErr}
+	}
+
+	if result != nil {
+		return *result
+	}
+
+	targetfile, err := storage.StoreChildImage(
+		namespace,
+		format,
+		bytes.NewReader(data),
+		controller.Image().Bounds().Dx(),
+		controller.Image().Bounds().Dy(),
+		original,
+		entry,
+	)
+
+	if err != nil {
+		return resizeResult{status: http.StatusInternalServerError, err: err}
+	}
+
+	return resizeResult{image: targetfile, data: data}
+}
+
+//originalFaces returns the faces of the original. They are detected only once per detection size,
+//if the storage implements `MetaUpdater` they will be cached in the metadata of the original
+func originalFaces(
+	original Cacheable,
+	namespace string,
+	storage Storage,
+	img image.Image,
+	detector paint.FaceDetector,
+	options paint.FaceOptions,
+) ([]image.Rectangle, error) {
+	if metaContainer, ok := original.(MetaContainer); ok {
+		if faces, found := paint.FacesFromMeta(metaContainer.Meta(), options.DetectionSize, original.CacheIdentifier()); found {
+			return faces, nil
 		}
+	}
 
-		respondWithImage(w, r, targetfile, bytes.NewReader(data))
-		log.Printf("%d image succesfully resized and returned.\n", http.StatusOK)
+	faces, err := detector.DetectFaces(img, options)
+	if err != nil {
+		return nil, err
+	}
 
-		return
+	if updater, ok := storage.(MetaUpdater); ok {
+		meta := map[string]interface{}{paint.FacesMetaKey(options.DetectionSize): paint.NewCachedFaces(original.CacheIdentifier(), faces)}
+		if err := updater.UpdateMeta(namespace, original, meta); err != nil {
+			log.Printf("Faces of %s could not be cached. Reason: [%s].\n", original.Name(), err.Error())
+		}
 	}
 
-	respondWithImage(w, r, img, img.Data())
+	return faces, nil
+}
+
+//isOutdated returns true if the resized image was created from a different version of the original.
+//resized images without a recorded fingerprint of their original are considered up to date.
+//Images cropped around a focal point are outdated as well, if the focal point has been moved.
+func isOutdated(child, original Cacheable, entry *Entry) bool {
+	metaContainer, ok := child.(MetaContainer)
+	if !ok {
+		return false
+	}
+
+	childMeta := metaContainer.Meta()
+	if md5, found := paint.MetaValue(childMeta, "originalMD5"); found && fmt.Sprint(md5) != original.CacheIdentifier() {
+		return true
+	}
+
+	originalContainer, ok := original.(MetaContainer)
+	if entry.Type != paint.TypeFocus || !ok {
+		return false
+	}
+
+	for _, key := range []string{paint.FocusXKey, paint.FocusYKey} {
+		originalValue, _ := paint.MetaValue(originalContainer.Meta(), key)
+		childValue, _ := paint.MetaValue(childMeta, key)
+		if fmt.Sprint(originalValue) != fmt.Sprint(childValue) {
+			return true
+		}
+	}
+
+	return false
 }
 
 func getResizeImage(entry Entry, filename, database string, storage Storage) (Cacheable, error) {
@@ -195,6 +415,83 @@ func getOriginalImage(filename, database string, storage Storage) (Cacheable, er
 	return foundImage, err
 }
 
+//facesHandler responds with the faces of the original in its coordinates as json.
+//Faces that are not cached in the metadata of the original yet, are detected by the processing pool
+func facesHandler(w http.ResponseWriter, r *http.Request, storage Storage, pool *processingPool, limits paint.Limits) {
+	log.Printf("Request on %s", r.URL)
+
+	requestConfig, err := CreateConfigurationFromVars(r, mux.Vars(r))
+	if err != nil {
+		log.Printf("%d invalid request parameters given.\n", http.StatusNotFound)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	original, err := getOriginalImage(requestConfig.Filename, requestConfig.Namespace(), storage)
+	if err != nil {
+		log.Printf("%d file not found.\n", http.StatusNotFound)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	defer original.Data().Close()
+
+	var faces []image.Rectangle
+	found := false
+	if metaContainer, ok := original.(MetaContainer); ok {
+		faces, found = paint.FacesFromMeta(metaContainer.Meta(), 0, original.CacheIdentifier())
+	}
+
+	if !found {
+		detector := paint.GetFaceDetector()
+		if detector == nil {
+			log.Printf("%d no face detector registered.\n", http.StatusNotImplemented)
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+
+		status := http.StatusOK
+		poolErr := pool.run(func() {
+			controller, err := paint.NewControllerWithLimits(original.Data(), paint.GetCustomResizers(), limits)
+			if _, tooLarge := err.(paint.ImageTooLargeError); tooLarge {
+				status = statusUnprocessableEntity
+			} else if err != nil {
+				status = http.StatusNotFound
+			} else {
+				faces, err = originalFaces(original, requestConfig.Namespace(), storage, controller.Image(), detector, paint.FaceOptions{})
+				if err != nil {
+					status = http.StatusInternalServerError
+				}
+			}
+
+			if err != nil {
+				log.Printf("%d faces could not be detected. Reason: [%s].\n", status, err.Error())
+			}
+		})
+
+		if poolErr != nil {
+			log.Printf("%d faces could not be detected. Reason: [%s].\n", http.StatusServiceUnavailable, poolErr.Error())
+			w.Header().Set("Retry-After", strconv.Itoa(pool.retryAfter()))
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"faces": paint.NewFaces(faces)})
+	log.Printf("%d Responding with %d faces.\n", http.StatusOK, len(faces))
+}
+
+//statsHandler responds with the statistics of the processing pool
+func statsHandler(w http.ResponseWriter, r *http.Request, pool *processingPool) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pool.stats())
+}
+
 // just a static welcome handler
 func welcomeHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "<html>")
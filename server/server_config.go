@@ -8,10 +8,20 @@ import (
 // Configuration is a wrapper object for request parameters.
 type Configuration struct {
 	Database   string
+	Bucket     string
 	FormatName string
 	Filename   string
 }
 
+// Namespace returns the namespace for the storage, either the database or database/bucket
+func (c Configuration) Namespace() string {
+	if c.Bucket == "" {
+		return c.Database
+	}
+
+	return c.Database + "/" + c.Bucket
+}
+
 // CreateConfigurationFromVars validate all necessary request parameters
 func CreateConfigurationFromVars(r *http.Request, vars map[string]string) (*Configuration, error) {
 
@@ -29,5 +39,5 @@ func CreateConfigurationFromVars(r *http.Request, vars map[string]string) (*Conf
 
 	formatName := r.URL.Query().Get("size")
 
-	return &Configuration{Database: database, FormatName: formatName, Filename: filename}, nil
+	return &Configuration{Database: database, Bucket: vars["bucket"], FormatName: formatName, Filename: filename}, nil
 }
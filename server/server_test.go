@@ -1,6 +1,7 @@
 package server_test
 
 import (
+	"bytes"
 	"image"
 	"io"
 	"net/http"
@@ -109,27 +110,31 @@ var _ = Describe("Server", func() {
 			storage      Storage
 		)
 
-		BeforeSuite(func() {
+		BeforeEach(func() {
+			rec = httptest.NewRecorder()
+
+			// connect only once, specs that don't need mongodb
+			// should not depend on a running server
+			if connection != nil {
+				return
+			}
+
 			var err error
 			databaseName = "testdb"
 			config, err = NewConfigFromBytes([]byte(testConfig))
 			Expect(err).ToNot(HaveOccurred())
 			connection, err = mgo.Dial("localhost:27017")
-			connection.SetMode(mgo.Monotonic, true)
 			Expect(err).ToNot(HaveOccurred())
+			connection.SetMode(mgo.Monotonic, true)
 			storage, err = NewGridfsStorage(connection)
 			Expect(err).ToNot(HaveOccurred())
-			imageServer = NewImageServer(config, GridfsStorage{Connection: connection})
+			imageServer = NewImageServer(config, storage)
 			database = connection.DB(databaseName)
 			Expect(database).ToNot(BeNil())
 			database.DropDatabase()
 			gridfs = database.GridFS("fs")
 		})
 
-		BeforeEach(func() {
-			rec = httptest.NewRecorder()
-		})
-
 		It("Should response with welcome on /", func() {
 			req, err := http.NewRequest("GET", "/", nil)
 			Expect(err).ToNot(HaveOccurred())
@@ -223,6 +228,201 @@ var _ = Describe("Server", func() {
 			Expect(actual).To(ContainElement("MIT"))
 		})
 
+		It("will resize images of other buckets and reference the original collection", func() {
+			avatars := database.GridFS("avatars")
+			err := loadFixtureFile("./testdata/image.jpg", "avatar.jpg", avatars, map[string]string{})
+			Expect(err).ToNot(HaveOccurred())
+			req, err := http.NewRequest("GET", "/"+databaseName+"/avatars/avatar.jpg?size=45x35", nil)
+			Expect(err).ToNot(HaveOccurred())
+			handler := imageServer.Handler()
+			handler.ServeHTTP(rec, req)
+			Expect(rec.Code).To(Equal(http.StatusOK))
+
+			var file *mgo.GridFile
+			query := avatars.Find(bson.M{"metadata.originalFilename": "avatar.jpg", "metadata.size": "45x35"})
+			ok := avatars.OpenNext(query.Iter(), &file)
+			Expect(ok).To(Equal(true), "could find file successfully")
+
+			actual := struct {
+				Original mgo.DBRef `bson:"original"`
+			}{}
+			err = file.GetMeta(&actual)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(actual.Original.Collection).To(Equal("avatars.files"))
+
+			count, err := gridfs.Find(bson.M{"metadata.originalFilename": "avatar.jpg"}).Count()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(count).To(Equal(0))
+		})
+
+		It("will not mix up resized images of buckets that share the collection of resized images", func() {
+			shared, err := NewGridfsStorageWithPrefix(connection, "", "thumbs")
+			Expect(err).ToNot(HaveOccurred())
+			sharedServer := NewImageServer(config, shared)
+
+			err = loadFixtureFile("./testdata/image.jpg", "shared.jpg", database.GridFS("avatars"), map[string]string{})
+			Expect(err).ToNot(HaveOccurred())
+			err = loadFixtureFile("./testdata/normal.png", "shared.jpg", database.GridFS("products"), map[string]string{})
+			Expect(err).ToNot(HaveOccurred())
+
+			serve := func(url string) []byte {
+				req, err := http.NewRequest("GET", url, nil)
+				Expect(err).ToNot(HaveOccurred())
+				rec := httptest.NewRecorder()
+				sharedServer.Handler().ServeHTTP(rec, req)
+				Expect(rec.Code).To(Equal(http.StatusOK))
+				return rec.Body.Bytes()
+			}
+
+			avatar := serve("/" + databaseName + "/avatars/shared.jpg?size=45x35")
+			product := serve("/" + databaseName + "/products/shared.jpg?size=45x35")
+			Expect(product).ToNot(Equal(avatar))
+			Expect(serve("/" + databaseName + "/avatars/shared.jpg?size=45x35")).To(Equal(avatar))
+			Expect(serve("/" + databaseName + "/products/shared.jpg?size=45x35")).To(Equal(product))
+
+			for _, collection := range []string{"avatars.files", "products.files"} {
+				count, err := database.GridFS("thumbs").Find(bson.M{"metadata.original.$ref": collection}).Count()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(count).To(Equal(1))
+			}
+		})
+
+		It("will keep only the oldest of duplicate resized images", func() {
+			err := loadFixtureFile("./testdata/image.jpg", "duplicate.jpg", gridfs, map[string]string{})
+			Expect(err).ToNot(HaveOccurred())
+			original, err := storage.FindImageByParentFilename(databaseName, "duplicate.jpg", nil)
+			Expect(err).ToNot(HaveOccurred())
+			entry := &Entry{Name: "45x35", Width: 45, Height: 35, Type: "resize"}
+
+			first, err := storage.StoreChildImage(databaseName, "jpeg", bytes.NewReader([]byte("first")), 45, 35, original, entry)
+			Expect(err).ToNot(HaveOccurred())
+			second, err := storage.StoreChildImage(databaseName, "jpeg", bytes.NewReader([]byte("second")), 45, 35, original, entry)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(second.(Identity).ID()).To(Equal(first.(Identity).ID()))
+
+			count, err := gridfs.Find(bson.M{"metadata.originalFilename": "duplicate.jpg"}).Count()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(count).To(Equal(1))
+		})
+
+		It("will keep resized images of the focus type once the focal point has been moved", func() {
+			err := loadFixtureFile("./testdata/image.jpg", "focus.jpg", gridfs, map[string]string{"focusX": "0", "focusY": "0.5"})
+			Expect(err).ToNot(HaveOccurred())
+			original, err := storage.FindImageByParentFilename(databaseName, "focus.jpg", nil)
+			Expect(err).ToNot(HaveOccurred())
+			entry := &Entry{Name: "square", Width: 50, Height: 50, Type: "focus"}
+
+			left, err := storage.StoreChildImage(databaseName, "jpeg", bytes.NewReader([]byte("left")), 50, 50, original, entry)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(storage.(MetaUpdater).UpdateMeta(databaseName, original, map[string]interface{}{"focusX": "1"})).To(Succeed())
+			original, err = storage.FindImageByParentFilename(databaseName, "focus.jpg", nil)
+			Expect(err).ToNot(HaveOccurred())
+
+			right, err := storage.StoreChildImage(databaseName, "jpeg", bytes.NewReader([]byte("right")), 50, 50, original, entry)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(right.(Identity).ID()).ToNot(Equal(left.(Identity).ID()))
+
+			child, err := storage.FindImageByParentFilename(databaseName, "focus.jpg", entry)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(child.(Identity).ID()).To(Equal(right.(Identity).ID()))
+			Expect(child.(MetaContainer).Meta()).To(HaveKeyWithValue("focusX", "1"))
+
+			_, err = storage.(Deduplicator).RemoveDuplicates(databaseName)
+			Expect(err).ToNot(HaveOccurred())
+			child, err = storage.FindImageByParentFilename(databaseName, "focus.jpg", entry)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(child.(Identity).ID()).To(Equal(right.(Identity).ID()))
+		})
+
+		It("will find the resized image of the focus type once the focal point has been moved back", func() {
+			err := loadFixtureFile("./testdata/image.jpg", "moved.jpg", gridfs, map[string]string{"focusX": "0", "focusY": "0.5"})
+			Expect(err).ToNot(HaveOccurred())
+			entry := &Entry{Name: "square", Width: 50, Height: 50, Type: "focus"}
+
+			var stored []Cacheable
+			for _, focusX := range []string{"0", "1", "0"} {
+				original, err := storage.FindImageByParentFilename(databaseName, "moved.jpg", nil)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(storage.(MetaUpdater).UpdateMeta(databaseName, original, map[string]interface{}{"focusX": focusX})).To(Succeed())
+				original, err = storage.FindImageByParentFilename(databaseName, "moved.jpg", nil)
+				Expect(err).ToNot(HaveOccurred())
+
+				child, err := storage.StoreChildImage(databaseName, "jpeg", bytes.NewReader([]byte(focusX)), 50, 50, original, entry)
+				Expect(err).ToNot(HaveOccurred())
+				stored = append(stored, child)
+			}
+
+			child, err := storage.FindImageByParentFilename(databaseName, "moved.jpg", entry)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(child.(Identity).ID()).To(Equal(stored[2].(Identity).ID()))
+			Expect(child.(MetaContainer).Meta()).To(HaveKeyWithValue("focusX", "0"))
+
+			count, err := gridfs.Find(bson.M{"metadata.originalFilename": "moved.jpg"}).Count()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(count).To(Equal(1))
+		})
+
+		It("will remove duplicate resized images of older versions", func() {
+			metadata := map[string]string{
+				"originalFilename": "legacy.jpg",
+				"size":             "45x35",
+				"resizeType":       "resize",
+			}
+
+			legacy := database.GridFS("legacy")
+			for _, name := range []string{"oldest.jpg", "newer.jpg", "newest.jpg"} {
+				err := loadFixtureFile("./testdata/image.jpg", name, legacy, metadata)
+				Expect(err).ToNot(HaveOccurred())
+			}
+
+			removed, err := storage.(Deduplicator).RemoveDuplicates(databaseName + "/legacy")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(removed).To(Equal(2))
+
+			query := legacy.Find(bson.M{"metadata.originalFilename": "legacy.jpg"})
+			count, err := query.Count()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(count).To(Equal(1))
+
+			var file *mgo.GridFile
+			Expect(legacy.OpenNext(query.Iter(), &file)).To(BeTrue())
+			Expect(file.Name()).To(Equal("oldest.jpg"))
+
+			duplicate, err := legacy.Create("duplicate.jpg")
+			Expect(err).ToNot(HaveOccurred())
+			duplicate.SetMeta(metadata)
+			_, err = duplicate.Write([]byte("duplicate"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(mgo.IsDup(duplicate.Close())).To(BeTrue())
+		})
+
+		It("will keep only the newest resized image of the focus type", func() {
+			focus := database.GridFS("focus")
+			for _, file := range [][2]string{{"left.jpg", "0"}, {"right.jpg", "1"}, {"newest.jpg", "1"}} {
+				metadata := map[string]string{
+					"originalFilename": "focus.jpg",
+					"size":             "45x35",
+					"resizeType":       "focus",
+					"FocusX":           file[1],
+					"FocusY":           "0.5",
+				}
+
+				err := loadFixtureFile("./testdata/image.jpg", file[0], focus, metadata)
+				Expect(err).ToNot(HaveOccurred())
+			}
+
+			removed, err := storage.(Deduplicator).RemoveDuplicates(databaseName + "/focus")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(removed).To(Equal(2))
+
+			var files []struct {
+				Filename string `bson:"filename"`
+			}
+			Expect(focus.Find(bson.M{"metadata.originalFilename": "focus.jpg"}).All(&files)).To(Succeed())
+			Expect(files).To(HaveLen(1))
+			Expect(files[0].Filename).To(Equal("newest.jpg"))
+		})
+
 		It("will respond only with not modified if correct if none match got sent", func() {
 			metadata := map[string]string{}
 
@@ -0,0 +1,339 @@
+package server
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/VoycerAG/gridfs-image-server/server/paint"
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	// metaHeaderPrefix is the prefix of request headers that will be stored as metadata
+	metaHeaderPrefix = "X-Image-Meta-"
+)
+
+var (
+	errUploadTooLarge = errors.New("upload too large")
+	errNoUploadFile   = errors.New("no file found in multipart request")
+	errMultipleFiles  = errors.New("more than one file found in multipart request")
+
+	// reservedMetaKeys are written by the server itself, uploads must not set them.
+	// otherwise originals could be mistaken for resized images or resized images could reference the wrong original
+	reservedMetaKeys = []string{
+		"original",
+		"originalFilename",
+		"originalMD5",
+		"originalUploadDate",
+		"resizeType",
+		"size",
+		"width",
+		"height",
+		"format",
+		"options",
+		"contentType",
+	}
+)
+
+// UploadResponse will be returned as json after an image has been stored
+type UploadResponse struct {
+	ID       string `json:"id"`
+	Filename string `json:"filename"`
+	URL      string `json:"url"`
+}
+
+// isAuthorized returns true if the request contains the configured bearer token
+func isAuthorized(r *http.Request, token string) bool {
+	if token == "" {
+		return false
+	}
+
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return false
+	}
+
+	given := strings.TrimPrefix(authorization, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+// uploadHandler stores a new original either from a raw or a multipart body.
+// without a filename in the request, a random filename will be generated
+func uploadHandler(w http.ResponseWriter, r *http.Request, storage Storage, imageConfig Config, pool *processingPool) {
+	log.Printf("Upload on %s", r.URL)
+
+	if !isAuthorized(r, imageConfig.AuthToken) {
+		log.Printf("%d unauthorized upload.\n", http.StatusUnauthorized)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	requestConfig := Configuration{Database: vars["database"], Bucket: vars["bucket"], Filename: vars["filename"]}
+	if requestConfig.Database == "" {
+		log.Printf("%d invalid request parameters given.\n", http.StatusNotFound)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	data, metadata, err := readUpload(r, imageConfig.Upload.MaxBytes)
+	if err != nil {
+		status := http.StatusBadRequest
+		if err == errUploadTooLarge {
+			status = http.StatusRequestEntityTooLarge
+		}
+
+		log.Printf("%d could not read upload. Reason: [%s].\n", status, err.Error())
+		w.WriteHeader(status)
+		return
+	}
+
+	imageConf, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		log.Printf("%d upload is no image. Reason: [%s].\n", http.StatusBadRequest, err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if int64(imageConf.Width)*int64(imageConf.Height) > imageConfig.Upload.MaxPixels {
+		log.Printf("%d image with %dx%d pixels is too large.\n", http.StatusRequestEntityTooLarge, imageConf.Width, imageConf.Height)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var decodeErr error
+	poolErr := pool.run(func() {
+		_, decodeErr = paint.NewControllerWithLimits(bytes.NewReader(data), paint.GetCustomResizers(), imageConfig.Limits)
+	})
+
+	if poolErr != nil {
+		log.Printf("%d image could not be decoded. Reason: [%s].\n", http.StatusServiceUnavailable, poolErr.Error())
+		w.Header().Set("Retry-After", strconv.Itoa(pool.retryAfter()))
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	if _, tooLarge := decodeErr.(paint.ImageTooLargeError); tooLarge {
+		log.Printf("%d image could not be decoded. Reason: [%s].\n", http.StatusRequestEntityTooLarge, decodeErr.Error())
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if decodeErr != nil {
+		log.Printf("%d image could not be decoded. Reason: [%s].\n", http.StatusBadRequest, decodeErr.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if requestConfig.Filename == "" {
+		requestConfig.Filename = getRandomFilename(format)
+	}
+
+	img, err := storage.StoreImage(
+		requestConfig.Namespace(),
+		requestConfig.Filename,
+		"image/"+format,
+		bytes.NewReader(data),
+		metadata,
+	)
+
+	if err != nil {
+		log.Printf("%d error %s\n", http.StatusInternalServerError, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	response := UploadResponse{
+		ID:       requestConfig.Filename,
+		Filename: requestConfig.Filename,
+		URL:      "/" + requestConfig.Namespace() + "/" + requestConfig.Filename,
+	}
+
+	if identifier, ok := img.(Identity); ok {
+		switch id := identifier.ID().(type) {
+		case bson.ObjectId:
+			response.ID = id.Hex()
+		case string:
+			response.ID = id
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", response.URL)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+	log.Printf("%d image %s stored.\n", http.StatusCreated, response.URL)
+}
+
+// DeleteResponse will be returned as json after an image has been deleted
+type DeleteResponse struct {
+	Removed int `json:"removed"`
+}
+
+// deleteHandler removes an original, found by its filename or id, together with all of its resized images
+func deleteHandler(w http.ResponseWriter, r *http.Request, storage Storage, imageConfig Config) {
+	log.Printf("Delete on %s", r.URL)
+
+	if !isAuthorized(r, imageConfig.AuthToken) {
+		log.Printf("%d unauthorized delete.\n", http.StatusUnauthorized)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	requestConfig := Configuration{Database: vars["database"], Bucket: vars["bucket"], Filename: vars["filename"]}
+	removed, err := storage.DeleteImage(requestConfig.Namespace(), requestConfig.Filename)
+	if err != nil {
+		log.Printf("%d error %s\n", http.StatusInternalServerError, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if removed == 0 {
+		log.Printf("%d image %s not found.\n", http.StatusNotFound, r.URL)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(DeleteResponse{Removed: removed})
+	log.Printf("%d image %s deleted, %d files removed.\n", http.StatusOK, r.URL, removed)
+}
+
+// limitedReader fails with errUploadTooLarge if more than n bytes are read
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n, errUploadTooLarge
+	}
+
+	return n, err
+}
+
+// readUpload returns the uploaded file and its metadata.
+// Metadata can be sent as X-Image-Meta-* headers, or as additional form values of multipart requests
+func readUpload(r *http.Request, maxBytes int64) ([]byte, map[string]interface{}, error) {
+	if r.ContentLength > maxBytes {
+		return nil, nil, errUploadTooLarge
+	}
+
+	metadata := map[string]interface{}{}
+	for k := range r.Header {
+		if strings.HasPrefix(k, metaHeaderPrefix) && len(k) > len(metaHeaderPrefix) {
+			// header names are case insensitive, so their keys are lowercased
+			key, err := uploadMetaKey(strings.ToLower(k[len(metaHeaderPrefix):]))
+			if err != nil {
+				return nil, nil, err
+			}
+
+			metadata[key] = r.Header.Get(k)
+		}
+	}
+
+	body := &limitedReader{r: r.Body, n: maxBytes}
+	mediaType, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		data, err := ioutil.ReadAll(body)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return data, metadata, nil
+	}
+
+	var data []byte
+	reader := multipart.NewReader(body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+
+		if body.n < 0 {
+			return nil, nil, errUploadTooLarge
+		}
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		value, err := ioutil.ReadAll(part)
+		if body.n < 0 {
+			return nil, nil, errUploadTooLarge
+		}
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if part.FileName() != "" {
+			if data != nil {
+				return nil, nil, errMultipleFiles
+			}
+
+			data = value
+		} else if part.FormName() != "" {
+			key, err := uploadMetaKey(part.FormName())
+			if err != nil {
+				return nil, nil, err
+			}
+
+			metadata[key] = string(value)
+		}
+	}
+
+	if data == nil {
+		return nil, nil, errNoUploadFile
+	}
+
+	return data, metadata, nil
+}
+
+// uploadMetaKey returns the key under which uploaded metadata will be stored.
+// Keys that are reserved by the server, faces that are cached by the server and keys that can not
+// be stored in mongodb are rejected. The focal point keeps the case the focus resize type expects
+func uploadMetaKey(key string) (string, error) {
+	if strings.ContainsAny(key, "$.") {
+		return "", fmt.Errorf("invalid metadata key %s", key)
+	}
+
+	for _, reserved := range reservedMetaKeys {
+		if strings.EqualFold(key, reserved) {
+			return "", fmt.Errorf("reserved metadata key %s", key)
+		}
+	}
+
+	if paint.IsFacesKey(key) {
+		return "", fmt.Errorf("reserved metadata key %s", key)
+	}
+
+	for _, focusKey := range []string{paint.FocusXKey, paint.FocusYKey} {
+		if strings.EqualFold(key, focusKey) {
+			return focusKey, nil
+		}
+	}
+
+	return key, nil
+}
@@ -0,0 +1,248 @@
+package server_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+
+	"gopkg.in/mgo.v2/bson"
+
+	. "github.com/VoycerAG/gridfs-image-server/server"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const (
+	uploadConfig = `
+{
+	"authToken" : "secret",
+	"upload" : {
+		"maxBytes" : 40000,
+		"maxPixels" : 1000000
+	},
+	"allowedEntries" : [
+		{
+			"name" : "45x35",
+			"width" : 45,
+			"height" : 35,
+			"type" : "resize"
+		}
+	]
+}
+	`
+)
+
+var _ = Describe("Upload of originals", func() {
+	var (
+		storage     *MemoryStorage
+		imageServer Server
+		testImage   []byte
+	)
+
+	upload := func(method, url string, body io.Reader, header http.Header) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, url, body)
+		Expect(err).ToNot(HaveOccurred())
+		req.Header.Set("Authorization", "Bearer secret")
+		for k, v := range header {
+			req.Header[k] = v
+		}
+
+		rec := httptest.NewRecorder()
+		imageServer.Handler().ServeHTTP(rec, req)
+		return rec
+	}
+
+	BeforeEach(func() {
+		config, err := NewConfigFromBytes([]byte(uploadConfig))
+		Expect(err).ToNot(HaveOccurred())
+		storage = NewMemoryStorage()
+		imageServer = NewImageServer(config, storage)
+		testImage, err = ioutil.ReadFile("./testdata/image.jpg")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("will reject requests without a valid token", func() {
+		req, err := http.NewRequest("PUT", "/testdb/test.jpg", bytes.NewReader(testImage))
+		Expect(err).ToNot(HaveOccurred())
+		req.Header.Set("Authorization", "Bearer invalid")
+		rec := httptest.NewRecorder()
+		imageServer.Handler().ServeHTTP(rec, req)
+		Expect(rec.Code).To(Equal(http.StatusUnauthorized))
+		Expect(storage.Images("testdb")).To(HaveLen(0))
+	})
+
+	It("will store raw bodies with the given filename and metadata", func() {
+		rec := upload("PUT", "/testdb/test.jpg", bytes.NewReader(testImage), http.Header{
+			"X-Image-Meta-Copyright": {"ACME Fantasia"},
+		})
+		Expect(rec.Code).To(Equal(http.StatusCreated))
+
+		response := UploadResponse{}
+		Expect(json.Unmarshal(rec.Body.Bytes(), &response)).To(Succeed())
+		Expect(response.Filename).To(Equal("test.jpg"))
+		Expect(response.URL).To(Equal("/testdb/test.jpg"))
+		Expect(storage.IsValidID(response.ID)).To(BeTrue())
+
+		original, err := storage.FindImageByParentID("testdb", response.ID, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(original.Name()).To(Equal("test.jpg"))
+		Expect(original.(MetaContainer).Meta()).To(HaveKeyWithValue("copyright", "ACME Fantasia"))
+
+		req, err := http.NewRequest("GET", response.URL+"?size=45x35", nil)
+		Expect(err).ToNot(HaveOccurred())
+		rec = httptest.NewRecorder()
+		imageServer.Handler().ServeHTTP(rec, req)
+		Expect(rec.Code).To(Equal(http.StatusOK))
+	})
+
+	It("will store multipart uploads with a generated filename", func() {
+		var body bytes.Buffer
+		writer := multipart.NewWriter(&body)
+		writer.WriteField("license", "MIT")
+		part, err := writer.CreateFormFile("file", "upload.jpg")
+		Expect(err).ToNot(HaveOccurred())
+		part.Write(testImage)
+		writer.Close()
+
+		rec := upload("POST", "/testdb/avatars", &body, http.Header{"Content-Type": {writer.FormDataContentType()}})
+		Expect(rec.Code).To(Equal(http.StatusCreated))
+
+		response := UploadResponse{}
+		Expect(json.Unmarshal(rec.Body.Bytes(), &response)).To(Succeed())
+		Expect(response.Filename).To(HaveSuffix(".jpeg"))
+		Expect(response.URL).To(Equal("/testdb/avatars/" + response.Filename))
+
+		original, err := storage.FindImageByParentFilename("testdb/avatars", response.Filename, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(original.(MetaContainer).Meta()).To(HaveKeyWithValue("license", "MIT"))
+	})
+
+	It("will reject multipart uploads with more than one file", func() {
+		var body bytes.Buffer
+		writer := multipart.NewWriter(&body)
+		part, err := writer.CreateFormFile("file", "upload.jpg")
+		Expect(err).ToNot(HaveOccurred())
+		part.Write(testImage)
+		part, err = writer.CreateFormFile("license", "license.txt")
+		Expect(err).ToNot(HaveOccurred())
+		part.Write([]byte("MIT"))
+		writer.Close()
+
+		rec := upload("POST", "/testdb", &body, http.Header{"Content-Type": {writer.FormDataContentType()}})
+		Expect(rec.Code).To(Equal(http.StatusBadRequest))
+		Expect(storage.Images("testdb")).To(HaveLen(0))
+	})
+
+	It("will reject metadata keys that are reserved or invalid", func() {
+		for _, header := range []http.Header{
+			{"X-Image-Meta-Resizetype": {"crop"}},
+			{"X-Image-Meta-Originalmd5": {"d41d8cd98f00b204e9800998ecf8427e"}},
+			{"X-Image-Meta-Faces": {"[]"}},
+			{"X-Image-Meta-Faces_2048": {"[]"}},
+			{"X-Image-Meta-$set": {"value"}},
+			{"X-Image-Meta-A.b": {"value"}},
+		} {
+			rec := upload("PUT", "/testdb/test.jpg", bytes.NewReader(testImage), header)
+			Expect(rec.Code).To(Equal(http.StatusBadRequest))
+		}
+
+		var body bytes.Buffer
+		writer := multipart.NewWriter(&body)
+		writer.WriteField("size", "45x35")
+		part, err := writer.CreateFormFile("file", "upload.jpg")
+		Expect(err).ToNot(HaveOccurred())
+		part.Write(testImage)
+		writer.Close()
+
+		rec := upload("POST", "/testdb", &body, http.Header{"Content-Type": {writer.FormDataContentType()}})
+		Expect(rec.Code).To(Equal(http.StatusBadRequest))
+		Expect(storage.Images("testdb")).To(HaveLen(0))
+	})
+
+	It("will keep the case of the focal point", func() {
+		rec := upload("PUT", "/testdb/test.jpg", bytes.NewReader(testImage), http.Header{
+			"X-Image-Meta-Focusx": {"0.25"},
+			"X-Image-Meta-Focusy": {"0.75"},
+		})
+		Expect(rec.Code).To(Equal(http.StatusCreated))
+
+		original, err := storage.FindImageByParentFilename("testdb", "test.jpg", nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(original.(MetaContainer).Meta()).To(HaveKeyWithValue("focusX", "0.25"))
+		Expect(original.(MetaContainer).Meta()).To(HaveKeyWithValue("focusY", "0.75"))
+	})
+
+	It("will generate unique filenames", func() {
+		filenames := map[string]bool{}
+		for i := 0; i < 50; i++ {
+			rec := upload("POST", "/testdb", bytes.NewReader(testImage), nil)
+			Expect(rec.Code).To(Equal(http.StatusCreated))
+
+			response := UploadResponse{}
+			Expect(json.Unmarshal(rec.Body.Bytes(), &response)).To(Succeed())
+			Expect(filenames).ToNot(HaveKey(response.Filename))
+			filenames[response.Filename] = true
+		}
+
+		Expect(storage.Images("testdb")).To(HaveLen(50))
+	})
+
+	It("will accept webp originals", func() {
+		data, err := ioutil.ReadFile("./testdata/image.webp")
+		Expect(err).ToNot(HaveOccurred())
+		rec := upload("POST", "/testdb", bytes.NewReader(data), nil)
+		Expect(rec.Code).To(Equal(http.StatusCreated))
+
+		response := UploadResponse{}
+		Expect(json.Unmarshal(rec.Body.Bytes(), &response)).To(Succeed())
+		Expect(response.Filename).To(HaveSuffix(".webp"))
+	})
+
+	It("will reject payloads that are no images", func() {
+		rec := upload("PUT", "/testdb/test.jpg", bytes.NewReader([]byte("no image")), nil)
+		Expect(rec.Code).To(Equal(http.StatusBadRequest))
+		Expect(storage.Images("testdb")).To(HaveLen(0))
+	})
+
+	It("will delete originals together with their resized images", func() {
+		original := storage.AddImage("testdb", "test.jpg", testImage, nil)
+		storage.AddImage("testdb", "other.jpg", testImage, nil)
+		req, err := http.NewRequest("GET", "/testdb/test.jpg?size=45x35", nil)
+		Expect(err).ToNot(HaveOccurred())
+		imageServer.Handler().ServeHTTP(httptest.NewRecorder(), req)
+		Expect(storage.Images("testdb")).To(HaveLen(3))
+
+		rec := upload("DELETE", "/testdb/"+original.(Identity).ID().(bson.ObjectId).Hex(), nil, nil)
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		response := DeleteResponse{}
+		Expect(json.Unmarshal(rec.Body.Bytes(), &response)).To(Succeed())
+		Expect(response.Removed).To(Equal(2))
+		Expect(storage.Images("testdb")).To(HaveLen(1))
+
+		rec = upload("DELETE", "/testdb/test.jpg", nil, nil)
+		Expect(rec.Code).To(Equal(http.StatusNotFound))
+	})
+
+	It("will reject deletes without a valid token", func() {
+		storage.AddImage("testdb", "test.jpg", testImage, nil)
+		req, err := http.NewRequest("DELETE", "/testdb/test.jpg", nil)
+		Expect(err).ToNot(HaveOccurred())
+		rec := httptest.NewRecorder()
+		imageServer.Handler().ServeHTTP(rec, req)
+		Expect(rec.Code).To(Equal(http.StatusUnauthorized))
+		Expect(storage.Images("testdb")).To(HaveLen(1))
+	})
+
+	It("will reject payloads that are too large", func() {
+		data, err := ioutil.ReadFile("./testdata/normal.png")
+		Expect(err).ToNot(HaveOccurred())
+		rec := upload("PUT", "/testdb/test.png", bytes.NewReader(data), nil)
+		Expect(rec.Code).To(Equal(http.StatusRequestEntityTooLarge))
+		Expect(storage.Images("testdb")).To(HaveLen(0))
+	})
+})